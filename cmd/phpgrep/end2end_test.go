@@ -1,7 +1,13 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,12 +23,7 @@ func TestEnd2End(t *testing.T) {
 	if err != nil {
 		t.Fatalf("getwd: %v", err)
 	}
-	phpgrepBin := filepath.Join(wd, "phpgrep.exe")
-
-	out, err := exec.Command("go", "build", "-race", "-o", phpgrepBin, ".").CombinedOutput()
-	if err != nil {
-		t.Fatalf("build phpgrep: %v: %s", err, out)
-	}
+	phpgrepBin := buildPhpgrep(t)
 
 	type patternTest struct {
 		pattern string
@@ -32,6 +33,13 @@ func TestEnd2End(t *testing.T) {
 		targets string
 		format  string
 		strict  bool
+
+		// args are the additional command-line flags.
+		args []string
+
+		// summary is the expected last output line,
+		// it's "found N matches" by default.
+		summary string
 	}
 	tests := []struct {
 		name  string
@@ -274,6 +282,107 @@ func TestEnd2End(t *testing.T) {
 				},
 			},
 		},
+
+		{
+			name: "limit",
+			tests: []patternTest{
+				{
+					pattern: `f($_)`,
+					args:    []string{"--limit", "0"},
+					matches: []string{
+						"a.php:3: f(1)",
+						"a.php:4: f(2)",
+						"b.php:3: f(3)",
+						"c.php:3: f(4)",
+					},
+				},
+				// With a single worker, the files are searched one by one in the path order.
+				{
+					pattern: `f($_)`,
+					args:    []string{"--limit", "1", "--workers", "1"},
+					matches: []string{"a.php:3: f(1)"},
+					summary: "results limited to 1 matches, the search was stopped early (found at least 2, 1 dropped)",
+				},
+				{
+					// c.php is not searched.
+					pattern: `f($_)`,
+					args:    []string{"--limit", "3", "--workers", "1"},
+					matches: []string{
+						"a.php:3: f(1)",
+						"a.php:4: f(2)",
+						"b.php:3: f(3)",
+					},
+				},
+				{
+					pattern: `f($_)`,
+					args:    []string{"--limit", "3", "--sort", "none", "--workers", "1", "--format", "{{.Match}}"},
+					targets: `a.php,b.php`,
+					matches: []string{"f(1)", "f(2)", "f(3)"},
+				},
+				{
+					pattern: `f($_)`,
+					args:    []string{"--limit", "1", "--sort", "none", "--workers", "1", "--format", "{{.Match}}"},
+					targets: `a.php`,
+					matches: []string{"f(1)"},
+					summary: "results limited to 1 matches, the search was stopped early (found at least 2, 1 dropped)",
+				},
+			},
+		},
+
+		{
+			name: "diff",
+			tests: []patternTest{
+				{
+					pattern: `f($_)`,
+					args:    []string{"--diff-file", "changes.diff", "--workers", "1"},
+					matches: []string{"b.php:3: f(4)"},
+				},
+				{
+					// a.php has more than --limit matches, but none of them are changed.
+					pattern: `f($_)`,
+					args:    []string{"--diff-file", "changes.diff", "--sort", "none", "--limit", "2", "--workers", "1"},
+					matches: []string{"b.php:3: f(4)"},
+				},
+			},
+		},
+
+		{
+			name: "include",
+			tests: []patternTest{
+				{
+					pattern: `f($_)`,
+					args:    []string{"--include", "src/**", "--exclude", "**/Tests/**"},
+					matches: []string{"src/a.php:3: f(1)"},
+				},
+				{
+					pattern: `f($_)`,
+					args:    []string{"--include", "src/**"},
+					matches: []string{
+						"src/Tests/ATest.php:3: f(2)",
+						"src/a.php:3: f(1)",
+					},
+				},
+			},
+		},
+
+		{
+			name: "markdown",
+			tests: []patternTest{
+				{
+					pattern: `f($_)`,
+					matches: []string{"a.php:3: f(4)"},
+				},
+				{
+					pattern: `f($_)`,
+					args:    []string{"--markdown"},
+					matches: []string{
+						"README.md:4: f(1)",
+						"README.md:15: f(3)",
+						"a.php:3: f(4)",
+					},
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -297,6 +406,7 @@ func TestEnd2End(t *testing.T) {
 				if test.strict {
 					phpgrepArgs = append(phpgrepArgs, "--strict-syntax")
 				}
+				phpgrepArgs = append(phpgrepArgs, test.args...)
 				phpgrepArgs = append(phpgrepArgs, "--no-color")
 				targets := "."
 				if test.targets != "" {
@@ -314,7 +424,11 @@ func TestEnd2End(t *testing.T) {
 				}
 				have := strings.Split(strings.TrimSpace(string(out)), "\n")
 				want := test.matches
-				want = append(want, fmt.Sprintf("found %d matches", len(test.matches)))
+				if test.summary != "" {
+					want = append(want, test.summary)
+				} else {
+					want = append(want, fmt.Sprintf("found %d matches", len(test.matches)))
+				}
 				if diff := cmp.Diff(want, have); diff != "" {
 					t.Errorf("output mismatch (+have -want):\n%s", diff)
 				}
@@ -327,6 +441,222 @@ func TestEnd2End(t *testing.T) {
 	}
 }
 
+func TestEnd2EndShardMerge(t *testing.T) {
+	phpgrepBin := buildPhpgrep(t)
+	target := filepath.Join("testdata", "shard")
+	tmpDir, err := ioutil.TempDir("", "phpgrep-shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	decode := func(data string) jsonReport {
+		var report jsonReport
+		if err := json.Unmarshal([]byte(data), &report); err != nil {
+			t.Fatalf("decode %q: %v", data, err)
+		}
+		return report
+	}
+
+	full, _ := runPhpgrep(t, phpgrepBin, target, "--json", ".", "f($_)")
+	want := decode(full)
+	if want.Found != 6 {
+		t.Fatalf("unsharded run found %d matches, want 6", want.Found)
+	}
+
+	var reports []string
+	for _, shard := range []string{"1/2", "2/2"} {
+		out, _ := runPhpgrep(t, phpgrepBin, target, "--json", "--shard", shard, ".", "f($_)")
+		report := filepath.Join(tmpDir, strings.Replace(shard, "/", "-", 1)+".json")
+		if err := ioutil.WriteFile(report, []byte(out), 0666); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, report)
+	}
+
+	merged, _ := runPhpgrep(t, phpgrepBin, ".", append([]string{"merge"}, reports...)...)
+	have := decode(merged)
+	want.Shards = []string{"1/2", "2/2"}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("merged report mismatch (-want +have):\n%s", diff)
+	}
+
+	// The same shard can't be merged twice.
+	cmd := exec.Command(phpgrepBin, "merge", reports[0], reports[0])
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("merged the duplicated shard: %s", out)
+	}
+}
+
+func TestEnd2EndCompareRev(t *testing.T) {
+	phpgrepBin := buildPhpgrep(t)
+	dir, err := ioutil.TempDir("", "phpgrep-compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(filename, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, filename), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git := func(args ...string) {
+		args = append([]string{"-c", "user.name=phpgrep", "-c", "user.email=phpgrep@example.com"}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	git("init", "-q")
+	writeFile("a.php", "<?php\nf(1);\nf(3);\n")
+	git("add", "a.php")
+	git("commit", "-q", "-m", "init")
+
+	// f(1) is moved, but it's not reported as a change.
+	writeFile("a.php", "<?php\n\nf(1);\nf(2);\n")
+	writeFile("b.php", "<?php\nf(5);\n")
+
+	stdout, stderr := runPhpgrep(t, phpgrepBin, dir,
+		"--compare-rev", "HEAD", "--format", "{{.Filename}}:{{.Line}}: {{.Match}}", "--no-color", ".", "f($_)")
+	have := strings.Split(strings.TrimSpace(stdout), "\n")
+	want := []string{
+		"- a.php:3: f(3)",
+		"+ a.php:4: f(2)",
+		"+ b.php:2: f(5)",
+	}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("output mismatch (-want +have):\n%s", diff)
+	}
+	summary := "compared to HEAD: 2 added, 1 removed, 1 unchanged matches"
+	if !strings.Contains(stderr, summary) {
+		t.Errorf("summary %q is not found in:\n%s", summary, stderr)
+	}
+}
+
+func TestEnd2EndArchives(t *testing.T) {
+	phpgrepBin := buildPhpgrep(t)
+	dir, err := ioutil.TempDir("", "phpgrep-archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var zipData bytes.Buffer
+	zw := zip.NewWriter(&zipData)
+	zipFiles := []struct{ name, data string }{
+		{"src/a.php", "<?php\nf(1);\n"},
+		{"src/b.php", "<?php\n\nf(2);\n"},
+		{"README.md", "f(3);\n"},
+	}
+	for _, f := range zipFiles {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(f.data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tarData bytes.Buffer
+	gz := gzip.NewWriter(&tarData)
+	tw := tar.NewWriter(gz)
+	contents := "<?php\nf(4);\n"
+	tw.WriteHeader(&tar.Header{Name: "src/c.php", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+	tw.Write([]byte(contents))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.zip"), zipData.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.tar.gz"), tarData.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args    []string
+		matches []string
+	}{
+		{
+			matches: []string{
+				"lib.tar.gz!/src/c.php:2: f(4)",
+				"lib.zip!/src/a.php:2: f(1)",
+				"lib.zip!/src/b.php:3: f(2)",
+			},
+		},
+		{
+			args: []string{"--exclude", `re:b\.php$`},
+			matches: []string{
+				"lib.tar.gz!/src/c.php:2: f(4)",
+				"lib.zip!/src/a.php:2: f(1)",
+			},
+		},
+	}
+	for _, test := range tests {
+		args := append([]string{"--format", "{{.Filename}}:{{.Line}}: {{.Match}}", "--no-color"}, test.args...)
+		args = append(args, "lib.zip,lib.tar.gz", "f($_)")
+		stdout, stderr := runPhpgrep(t, phpgrepBin, dir, args...)
+		have := strings.Split(strings.TrimSpace(stdout), "\n")
+		if diff := cmp.Diff(test.matches, have); diff != "" {
+			t.Errorf("%v: output mismatch (-want +have):\n%s", test.args, diff)
+		}
+		summary := fmt.Sprintf("found %d matches", len(test.matches))
+		if !strings.Contains(stderr, summary) {
+			t.Errorf("%v: summary %q is not found in:\n%s", test.args, summary, stderr)
+		}
+	}
+}
+
+// jsonReport is a subset of the --json report fields.
+type jsonReport struct {
+	Matches []struct {
+		Filename string `json:"filename"`
+		Line     int    `json:"line"`
+		Match    string `json:"match"`
+	} `json:"matches"`
+	Found  int      `json:"found"`
+	Shards []string `json:"shards"`
+}
+
+// buildPhpgrep builds the phpgrep binary into the current directory.
+func buildPhpgrep(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	phpgrepBin := filepath.Join(wd, "phpgrep.exe")
+	out, err := exec.Command("go", "build", "-race", "-o", phpgrepBin, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("build phpgrep: %v: %s", err, out)
+	}
+	return phpgrepBin
+}
+
+// runPhpgrep runs phpgrep inside the dir and returns its stdout and stderr.
+// The "no matches" exit code is not treated as an error.
+func runPhpgrep(t *testing.T, phpgrepBin, dir string, args ...string) (string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(phpgrepBin, args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil && getExitCode(err) != 1 {
+		t.Fatalf("run phpgrep %s: %v: %s", strings.Join(args, " "), err, stderr.String())
+	}
+	return stdout.String(), stderr.String()
+}
+
 func getExitCode(err error) int {
 	if exiterr, ok := err.(*exec.ExitError); ok {
 		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
@@ -0,0 +1,6 @@
+<?php
+
+f(1);
+f(2);
+f(3);
+$x = 1;
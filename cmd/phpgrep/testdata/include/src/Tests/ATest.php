@@ -0,0 +1,3 @@
+<?php
+
+f(2);
@@ -0,0 +1,4 @@
+<?php
+
+f(1);
+f(2);
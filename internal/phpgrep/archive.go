@@ -0,0 +1,430 @@
+package phpgrep
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// archiveSeparator separates the archive file name from the entry path,
+// like in "vendor.phar!/src/Foo.php".
+const archiveSeparator = "!/"
+
+// archiveExtensions are the target extensions that are searched as archives.
+var archiveExtensions = []string{".zip", ".tar", ".tar.gz", ".tgz", ".phar"}
+
+// Native phar format manifest entry flags.
+const (
+	pharCompressionMask = 0x0000F000
+	pharCompressedGzip  = 0x00001000
+	pharCompressedBzip2 = 0x00002000
+)
+
+const pharHaltToken = "__HALT_COMPILER();"
+
+func isArchiveFile(name string) bool {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasArchiveTargets(targets string) bool {
+	for _, target := range strings.Split(targets, ",") {
+		if isArchiveFile(strings.TrimSpace(target)) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArchiveEntry splits the "archive!/entry" file name.
+// ok is false if the filename is not an archive entry.
+func splitArchiveEntry(filename string) (archive, entry string, ok bool) {
+	i := strings.Index(filename, archiveSeparator)
+	if i == -1 || !isArchiveFile(filename[:i]) {
+		return filename, "", false
+	}
+	return filename[:i], filename[i+len(archiveSeparator):], true
+}
+
+func (p *program) validateArchiveTargets() error {
+	if !hasArchiveTargets(p.args.targets) {
+		return nil
+	}
+	// These modes need to modify or re-read the files by their names.
+	if p.args.replace || p.args.watch {
+		return fmt.Errorf("archive targets can't be combined with -i or --watch")
+	}
+	if p.args.diffBase != "" || p.args.diffFile != "" || p.args.compareRev != "" {
+		return fmt.Errorf("archive targets can't be combined with --diff-base, --diff-file or --compare-rev")
+	}
+	return nil
+}
+
+// readArchive reads the archive PHP entries and passes them to the fn one by one.
+// The format is detected by the contents, so a .phar can be a zip or tar archive as well.
+func (p *program) readArchive(filename string, fn func(f fileContents)) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return err
+		}
+		return p.readZipEntries(filename, zr, fn)
+
+	case bytes.HasPrefix(head, []byte("\x1f\x8b")):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r := bufio.NewReaderSize(gz, 512)
+		innerHead, err := r.Peek(512)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if isTarHeader(innerHead) {
+			return p.readTarEntries(filename, tar.NewReader(r), fn)
+		}
+		// Native phar format needs random access, so it's decompressed
+		// to the memory. Like the other entries, it's limited by the --max-file-size.
+		var data []byte
+		if p.maxFileSize != 0 {
+			data, err = ioutil.ReadAll(io.LimitReader(r, p.maxFileSize+1))
+		} else {
+			data, err = ioutil.ReadAll(r)
+		}
+		if err != nil {
+			return err
+		}
+		if p.maxFileSize != 0 && int64(len(data)) > p.maxFileSize {
+			// The rest is only counted for the skipped files report.
+			rest, err := io.Copy(ioutil.Discard, r)
+			if err != nil {
+				return err
+			}
+			fn(fileContents{filename: filename, tooLarge: true, size: int64(len(data)) + rest})
+			return nil
+		}
+		return p.readPharEntries(filename, bytes.NewReader(data), int64(len(data)), fn)
+
+	case isTarHeader(head):
+		return p.readTarEntries(filename, tar.NewReader(f), fn)
+
+	case strings.HasSuffix(filename, ".phar"):
+		return p.readPharEntries(filename, f, info.Size(), fn)
+
+	default:
+		return fmt.Errorf("unsupported archive format")
+	}
+}
+
+func isTarHeader(head []byte) bool {
+	// Both POSIX and GNU tar headers have the magic at 257.
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+// acceptArchiveEntry applies the usual file filters to the archive entry.
+// It returns the entry file name that is used for the matches.
+func (p *program) acceptArchiveEntry(archive, name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	filename := archive + archiveSeparator + name
+	p.stats.countWalked()
+
+	// The entry directories can be excluded as well.
+	for i := 0; i < len(name); i++ {
+		if name[i] != '/' {
+			continue
+		}
+		dir := &walkedPath{path: archive + archiveSeparator + name[:i], rel: name[:i], isDir: true}
+		if p.isExcluded(dir) {
+			p.stats.countSkippedExclude()
+			return "", false
+		}
+	}
+	entryPath := &walkedPath{path: filename, rel: name}
+	if p.isExcluded(entryPath) {
+		p.stats.countSkippedExclude()
+		return "", false
+	}
+	if !p.isPHPFile(path.Base(name)) {
+		p.stats.countSkippedExtension()
+		return "", false
+	}
+	if !p.isIncluded(entryPath) {
+		p.stats.countSkippedExclude()
+		return "", false
+	}
+	if !p.inShard(name) {
+		p.stats.countSkippedShard()
+		return "", false
+	}
+	return filename, true
+}
+
+// readArchiveEntry reads the entry data unless it exceeds the --max-file-size.
+func (p *program) readArchiveEntry(filename string, size int64, r io.Reader) (fileContents, error) {
+	if p.maxFileSize != 0 && size > p.maxFileSize {
+		return fileContents{filename: filename, tooLarge: true, size: size}, nil
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fileContents{}, fmt.Errorf("read %s: %v", filename, err)
+	}
+	return fileContents{filename: filename, data: data}, nil
+}
+
+func (p *program) readZipEntries(archive string, zr *zip.Reader, fn func(f fileContents)) error {
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		filename, ok := p.acceptArchiveEntry(archive, zf.Name)
+		if !ok {
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("open %s: %v", filename, err)
+		}
+		f, err := p.readArchiveEntry(filename, int64(zf.UncompressedSize64), r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		fn(f)
+	}
+	return nil
+}
+
+func (p *program) readTarEntries(archive string, tr *tar.Reader, fn func(f fileContents)) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		filename, ok := p.acceptArchiveEntry(archive, hdr.Name)
+		if !ok {
+			continue
+		}
+		f, err := p.readArchiveEntry(filename, hdr.Size, tr)
+		if err != nil {
+			return err
+		}
+		fn(f)
+	}
+}
+
+type pharEntry struct {
+	name           string
+	size           int64
+	compressedSize int64
+	flags          uint32
+	offset         int64
+}
+
+// readPharEntries reads the native phar format archive.
+// The stub that precedes the manifest is not searched.
+func (p *program) readPharEntries(archive string, r io.ReaderAt, size int64, fn func(f fileContents)) error {
+	entries, err := readPharManifest(r, size)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		filename, ok := p.acceptArchiveEntry(archive, e.name)
+		if !ok {
+			continue
+		}
+		var data io.Reader = io.NewSectionReader(r, e.offset, e.compressedSize)
+		var closer io.Closer
+		switch e.flags & pharCompressionMask {
+		case 0:
+			// Not compressed.
+		case pharCompressedGzip:
+			// PHP stores the raw deflate stream without the gzip header.
+			rc := flate.NewReader(data)
+			data, closer = rc, rc
+		case pharCompressedBzip2:
+			data = bzip2.NewReader(data)
+		default:
+			return fmt.Errorf("%s: unsupported compression flags %#x", filename, e.flags&pharCompressionMask)
+		}
+		// The manifest size was checked against --max-file-size,
+		// so the decompressed data can't exceed it.
+		f, err := p.readArchiveEntry(filename, e.size, io.LimitReader(data, e.size+1))
+		if closer != nil {
+			closer.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if int64(len(f.data)) > e.size {
+			return fmt.Errorf("%s: entry data is longer than the declared size %d", filename, e.size)
+		}
+		fn(f)
+	}
+	return nil
+}
+
+// readPharManifest parses the native phar manifest that follows the stub.
+// See https://www.php.net/manual/en/phar.fileformat.phar.php
+func readPharManifest(r io.ReaderAt, size int64) ([]pharEntry, error) {
+	offset, err := findPharHaltOffset(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var lenBuf [4]byte
+	if _, err := r.ReadAt(lenBuf[:], offset); err != nil {
+		return nil, fmt.Errorf("read manifest length: %v", err)
+	}
+	manifestLen := int64(binary.LittleEndian.Uint32(lenBuf[:]))
+	if offset+4+manifestLen > size {
+		return nil, fmt.Errorf("manifest length %d exceeds the file size", manifestLen)
+	}
+	manifest := make([]byte, manifestLen)
+	if _, err := r.ReadAt(manifest, offset+4); err != nil {
+		return nil, fmt.Errorf("read manifest: %v", err)
+	}
+
+	m := pharManifestReader{data: manifest}
+	numFiles := m.uint32()
+	m.skip(2)               // API version
+	m.skip(4)               // Global flags
+	m.skip(int(m.uint32())) // Alias
+	m.skip(int(m.uint32())) // Metadata
+	if m.err != nil {
+		return nil, fmt.Errorf("bad manifest header: %v", m.err)
+	}
+
+	dataOffset := offset + 4 + manifestLen
+	var entries []pharEntry
+	for i := uint32(0); i < numFiles; i++ {
+		var e pharEntry
+		e.name = string(m.bytes(int(m.uint32())))
+		e.size = int64(m.uint32())
+		m.skip(4) // Timestamp
+		e.compressedSize = int64(m.uint32())
+		m.skip(4) // CRC32
+		e.flags = m.uint32()
+		m.skip(int(m.uint32())) // Metadata
+		if m.err != nil {
+			return nil, fmt.Errorf("bad manifest entry %d: %v", i, m.err)
+		}
+		e.offset = dataOffset
+		dataOffset += e.compressedSize
+		if dataOffset > size {
+			return nil, fmt.Errorf("%s: entry data exceeds the file size", e.name)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// findPharHaltOffset returns the manifest offset, it follows
+// the __HALT_COMPILER(); token and an optional " ?>" with a newline.
+func findPharHaltOffset(r io.ReaderAt, size int64) (int64, error) {
+	const chunkSize = 64 * 1024
+	buf := make([]byte, chunkSize+len(pharHaltToken))
+	haltOffset := int64(-1)
+	for pos := int64(0); pos < size && haltOffset == -1; pos += chunkSize {
+		n, err := r.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.Index(buf[:n], []byte(pharHaltToken)); i != -1 {
+			haltOffset = pos + int64(i+len(pharHaltToken))
+		}
+	}
+	if haltOffset == -1 {
+		return 0, fmt.Errorf("%s not found, not a phar archive", pharHaltToken)
+	}
+
+	// The same rules as the PHP phar extension uses.
+	tail := make([]byte, 5)
+	n, err := r.ReadAt(tail, haltOffset)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	tail = tail[:n]
+	if len(tail) >= 3 && (tail[0] == ' ' || tail[0] == '\n') && tail[1] == '?' && tail[2] == '>' {
+		haltOffset += 3
+		switch {
+		case bytes.HasPrefix(tail[3:], []byte("\r\n")):
+			haltOffset += 2
+		case bytes.HasPrefix(tail[3:], []byte("\n")):
+			haltOffset++
+		}
+	}
+	return haltOffset, nil
+}
+
+// pharManifestReader decodes the little-endian manifest fields.
+// After the first error, all reads return zero values.
+type pharManifestReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (m *pharManifestReader) bytes(n int) []byte {
+	if m.err != nil {
+		return nil
+	}
+	if n < 0 || m.pos+n > len(m.data) {
+		m.err = fmt.Errorf("unexpected end of manifest at %d", m.pos)
+		return nil
+	}
+	b := m.data[m.pos : m.pos+n]
+	m.pos += n
+	return b
+}
+
+func (m *pharManifestReader) skip(n int) {
+	m.bytes(n)
+}
+
+func (m *pharManifestReader) uint32() uint32 {
+	b := m.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
@@ -0,0 +1,259 @@
+package phpgrep
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type archiveTestFile struct {
+	name string
+	data string
+}
+
+var archiveTestFiles = []archiveTestFile{
+	{"src/a.php", "<?php f();"},
+	{"./src/b.php", "<?php g();"},
+	{"README.md", "# readme"},
+	{"vendor/c.php", "<?php h();"},
+}
+
+func TestReadArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archives := map[string][]byte{
+		"test.zip":    makeTestZip(t),
+		"test.tar.gz": makeTestTarGz(t),
+		"test.phar":   makeTestPhar(0),
+		"zip.phar":    makeTestZip(t),
+	}
+	for name, data := range archives {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		p := &program{
+			args: arguments{phpFileExtList: []string{".php"}},
+		}
+		f, err := compilePathFilter("vendor/", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.excludes = append(p.excludes, f)
+
+		have := map[string]string{}
+		err = p.readArchive(filename, func(f fileContents) {
+			have[f.filename] = string(f.data)
+		})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		want := map[string]string{
+			filename + "!/src/a.php": "<?php f();",
+			filename + "!/src/b.php": "<?php g();",
+		}
+		if diff := cmp.Diff(want, have); diff != "" {
+			t.Errorf("%s: entries mismatch (-want +have):\n%s", name, diff)
+		}
+	}
+}
+
+func TestReadPharEntryLongerThanDeclared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test.phar")
+	if err := ioutil.WriteFile(filename, makeTestPhar(-1), 0666); err != nil {
+		t.Fatal(err)
+	}
+	p := &program{
+		args: arguments{phpFileExtList: []string{".php"}},
+	}
+	err = p.readArchive(filename, func(f fileContents) {
+		t.Errorf("unexpected entry %s", f.filename)
+	})
+	if err == nil || !strings.Contains(err.Error(), "longer than the declared size") {
+		t.Fatalf("expected the entry size error, have %v", err)
+	}
+}
+
+func TestReadGzippedPharSizeLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	phar := makeTestPhar(0)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(phar)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "test.phar.gz")
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		maxFileSize int64
+		want        []fileContents
+	}{
+		{
+			maxFileSize: int64(len(phar)) - 1,
+			want:        []fileContents{{filename: filename, tooLarge: true, size: int64(len(phar))}},
+		},
+		{
+			maxFileSize: int64(len(phar)),
+			want: []fileContents{
+				{filename: filename + "!/src/a.php", data: []byte("<?php f();")},
+				{filename: filename + "!/src/b.php", data: []byte("<?php g();")},
+				{filename: filename + "!/vendor/c.php", data: []byte("<?php h();")},
+			},
+		},
+	}
+	for _, test := range tests {
+		p := &program{
+			args:        arguments{phpFileExtList: []string{".php"}},
+			maxFileSize: test.maxFileSize,
+		}
+		var have []fileContents
+		err := p.readArchive(filename, func(f fileContents) {
+			have = append(have, f)
+		})
+		if err != nil {
+			t.Errorf("max size %d: %v", test.maxFileSize, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, have, cmp.AllowUnexported(fileContents{})); diff != "" {
+			t.Errorf("max size %d: entries mismatch (-want +have):\n%s", test.maxFileSize, diff)
+		}
+	}
+}
+
+func TestSplitArchiveEntry(t *testing.T) {
+	tests := []struct {
+		filename string
+		archive  string
+		entry    string
+		ok       bool
+	}{
+		{"lib.phar!/src/a.php", "lib.phar", "src/a.php", true},
+		{"dist/release.tar.gz!/a.php", "dist/release.tar.gz", "a.php", true},
+		{"src/a.php", "src/a.php", "", false},
+		{"src/wow!/a.php", "src/wow!/a.php", "", false},
+	}
+	for _, test := range tests {
+		archive, entry, ok := splitArchiveEntry(test.filename)
+		if archive != test.archive || entry != test.entry || ok != test.ok {
+			t.Errorf("splitArchiveEntry(%q): have (%q, %q, %v)", test.filename, archive, entry, ok)
+		}
+	}
+}
+
+func makeTestZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	if _, err := w.Create("src/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range archiveTestFiles {
+		fw, err := w.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(f.data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTestTarGz(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := tar.NewWriter(gz)
+	w.WriteHeader(&tar.Header{Name: "src/", Typeflag: tar.TypeDir, Mode: 0755})
+	w.WriteHeader(&tar.Header{Name: "src/link.php", Typeflag: tar.TypeSymlink, Linkname: "a.php"})
+	for _, f := range archiveTestFiles {
+		hdr := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.data))}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// makeTestPhar builds a native phar archive where every
+// second entry is compressed. The sizeDelta is added to the declared entry sizes.
+func makeTestPhar(sizeDelta int) []byte {
+	u32 := func(buf *bytes.Buffer, v int) {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(v))
+		buf.Write(b[:])
+	}
+
+	var manifest, contents bytes.Buffer
+	u32(&manifest, len(archiveTestFiles))
+	manifest.Write([]byte{0x11, 0x10}) // API version
+	u32(&manifest, 0x00010000)         // Global flags
+	u32(&manifest, len("test.phar"))
+	manifest.WriteString("test.phar")
+	u32(&manifest, 0) // Metadata
+	for i, f := range archiveTestFiles {
+		data := []byte(f.data)
+		flags := 0644
+		if i%2 == 1 {
+			var compressed bytes.Buffer
+			w, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+			w.Write(data)
+			w.Close()
+			data = compressed.Bytes()
+			flags |= pharCompressedGzip
+		}
+		u32(&manifest, len(f.name))
+		manifest.WriteString(f.name)
+		u32(&manifest, len(f.data)+sizeDelta)
+		u32(&manifest, 0) // Timestamp
+		u32(&manifest, len(data))
+		u32(&manifest, 0) // CRC32
+		u32(&manifest, flags)
+		u32(&manifest, 0) // Metadata
+		contents.Write(data)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<?php\nPhar::mapPhar('test.phar');\n__HALT_COMPILER(); ?>\r\n")
+	u32(&buf, manifest.Len())
+	buf.Write(manifest.Bytes())
+	buf.Write(contents.Bytes())
+	return buf.Bytes()
+}
@@ -0,0 +1,227 @@
+package phpgrep
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blameDateLayout is the same as git --date=iso uses.
+const blameDateLayout = "2006-01-02 15:04:05 -0700"
+
+// blameInfo describes the commit that touched the match most recently.
+type blameInfo struct {
+	commit     string
+	author     string
+	authorDate string
+
+	committerTime int64
+}
+
+// blameCache stores the git blame results, so every file is blamed once.
+type blameCache struct {
+	mu    sync.Mutex
+	files map[string]*fileBlame
+}
+
+type fileBlame struct {
+	once sync.Once
+
+	// lines[i] is the i+1 line blame.
+	// It's empty if git blame failed.
+	lines []*blameInfo
+}
+
+func newBlameCache() *blameCache {
+	return &blameCache{files: make(map[string]*fileBlame)}
+}
+
+func (c *blameCache) file(rev, filename string) *fileBlame {
+	key := rev + "\x00" + filename
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.files[key]
+	if f == nil {
+		f = &fileBlame{}
+		c.files[key] = f
+	}
+	return f
+}
+
+// forget removes the file blame from the cache after the file is modified.
+func (c *blameCache) forget(filename string) {
+	c.mu.Lock()
+	delete(c.files, "\x00"+filename)
+	c.mu.Unlock()
+}
+
+func (f *fileBlame) load(rev, filename string) {
+	f.once.Do(func() {
+		args := []string{"blame", "--porcelain"}
+		if rev != "" {
+			args = append(args, rev)
+		}
+		args = append(args, "--", filename)
+		out, err := runGit(args...)
+		if err == nil {
+			f.lines, err = parseBlamePorcelain(out)
+		}
+		if err != nil {
+			// Reported only once, since the result is cached.
+			log.Printf("error: blame %s: %v", filename, err)
+		}
+	})
+}
+
+// matchBlame returns the most recent commit among the match lines.
+func (f *fileBlame) matchBlame(m match) *blameInfo {
+	endLine := m.endLine
+	if endLine < m.line {
+		endLine = m.line
+	}
+	var result *blameInfo
+	for line := m.line; line <= endLine && line <= len(f.lines); line++ {
+		info := f.lines[line-1]
+		if info != nil && (result == nil || info.committerTime > result.committerTime) {
+			result = info
+		}
+	}
+	if result == nil {
+		return &blameInfo{}
+	}
+	return result
+}
+
+// annotateBlame sets the blame info for the matches.
+// rev is the revision the matches were found in, it's empty for the working tree.
+func (p *program) annotateBlame(matches []match, rev string) {
+	if p.blame == nil {
+		return
+	}
+
+	// Files are blamed concurrently, one git process per file.
+	var filenames []string
+	seen := make(map[string]bool)
+	for i := range matches {
+		m := &matches[i]
+		if _, _, ok := splitArchiveEntry(m.filename); ok && m.blame == nil {
+			// Archive entries are not tracked by git.
+			m.blame = &blameInfo{}
+			continue
+		}
+		if m.blame == nil && !seen[m.filename] {
+			seen[m.filename] = true
+			filenames = append(filenames, m.filename)
+		}
+	}
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(p.args.workers)
+	for i := 0; i < p.args.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for filename := range queue {
+				p.blame.file(rev, filename).load(rev, filename)
+			}
+		}()
+	}
+	for _, filename := range filenames {
+		queue <- filename
+	}
+	close(queue)
+	wg.Wait()
+
+	for i := range matches {
+		m := &matches[i]
+		if m.blame == nil {
+			m.blame = p.blame.file(rev, m.filename).matchBlame(*m)
+		}
+	}
+}
+
+// parseBlamePorcelain parses the git blame --porcelain output.
+// The commit details are only printed for the first commit line,
+// so they're remembered for the subsequent lines.
+// The result is indexed by the final line number of every entry,
+// the lines without entries are nil.
+func parseBlamePorcelain(data []byte) ([]*blameInfo, error) {
+	var lines []*blameInfo
+	commits := make(map[string]*blameInfo)
+
+	var current *blameInfo
+	var finalLine int
+	var authorTime int64
+	var authorTZ string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "\t"):
+			// The source line itself finishes the entry.
+			if current == nil {
+				return nil, fmt.Errorf("unexpected source line")
+			}
+			if current.authorDate == "" && authorTime != 0 {
+				current.authorDate = formatBlameDate(authorTime, authorTZ)
+			}
+			for len(lines) < finalLine {
+				lines = append(lines, nil)
+			}
+			lines[finalLine-1] = current
+			current = nil
+			authorTime = 0
+			authorTZ = ""
+		case current == nil:
+			// "<sha> <orig-line> <final-line> [<num-lines>]".
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("unexpected line: %q", line)
+			}
+			n, err := strconv.Atoi(fields[2])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("unexpected final line number: %q", line)
+			}
+			finalLine = n
+			current = commits[fields[0]]
+			if current == nil {
+				current = &blameInfo{commit: fields[0]}
+				commits[fields[0]] = current
+			}
+		case strings.HasPrefix(line, "author "):
+			current.author = strings.TrimPrefix(line, "author ")
+		case strings.HasPrefix(line, "author-time "):
+			authorTime, _ = strconv.ParseInt(strings.TrimPrefix(line, "author-time "), 10, 64)
+		case strings.HasPrefix(line, "author-tz "):
+			authorTZ = strings.TrimPrefix(line, "author-tz ")
+		case strings.HasPrefix(line, "committer-time "):
+			current.committerTime, _ = strconv.ParseInt(strings.TrimPrefix(line, "committer-time "), 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+func formatBlameDate(unixTime int64, tz string) string {
+	t := time.Unix(unixTime, 0).UTC()
+	// tz is in +hhmm format.
+	if len(tz) == 5 {
+		hours, err1 := strconv.Atoi(tz[1:3])
+		minutes, err2 := strconv.Atoi(tz[3:5])
+		if err1 == nil && err2 == nil {
+			offset := hours*3600 + minutes*60
+			if tz[0] == '-' {
+				offset = -offset
+			}
+			t = t.In(time.FixedZone(tz, offset))
+		}
+	}
+	return t.Format(blameDateLayout)
+}
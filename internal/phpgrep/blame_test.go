@@ -0,0 +1,111 @@
+package phpgrep
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseBlamePorcelain(t *testing.T) {
+	out := "aaaa 1 1 2\n" +
+		"author Alice\n" +
+		"author-mail <alice@example.com>\n" +
+		"author-time 1600000000\n" +
+		"author-tz +0300\n" +
+		"committer Alice\n" +
+		"committer-time 1600000000\n" +
+		"filename a.php\n" +
+		"\t<?php\n" +
+		"aaaa 2 2\n" +
+		"\tf();\n" +
+		"bbbb 5 3 1\n" +
+		"author Bob\n" +
+		"author-time 1700000000\n" +
+		"author-tz -0130\n" +
+		"committer-time 1700000100\n" +
+		"filename a.php\n" +
+		"\tg();\n"
+
+	lines, err := parseBlamePorcelain([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(lines))
+	}
+	if lines[0] != lines[1] {
+		t.Errorf("lines of the same commit should share the blame info")
+	}
+
+	tests := []struct {
+		line       int
+		commit     string
+		author     string
+		authorDate string
+	}{
+		{1, "aaaa", "Alice", "2020-09-13 15:26:40 +0300"},
+		{3, "bbbb", "Bob", "2023-11-14 20:43:20 -0130"},
+	}
+	for _, test := range tests {
+		info := lines[test.line-1]
+		if info.commit != test.commit || info.author != test.author || info.authorDate != test.authorDate {
+			t.Errorf("line %d: got %s/%s/%s", test.line, info.commit, info.author, info.authorDate)
+		}
+	}
+
+	f := &fileBlame{lines: lines}
+	if got := f.matchBlame(match{line: 2, endLine: 3}); got.commit != "bbbb" {
+		t.Errorf("multi-line match: expected the most recent commit, got %s", got.commit)
+	}
+	if got := f.matchBlame(match{line: 10}); got.commit != "" {
+		t.Errorf("out of range match: expected empty blame, got %s", got.commit)
+	}
+}
+
+func TestParseBlamePorcelainOrder(t *testing.T) {
+	// The entries are keyed by the final line, not by their order.
+	out := "bbbb 7 3 1\n" +
+		"author Bob\n" +
+		"committer-time 1700000100\n" +
+		"filename a.php\n" +
+		"\tg();\n" +
+		"aaaa 1 1 1\n" +
+		"author Alice\n" +
+		"committer-time 1600000000\n" +
+		"filename a.php\n" +
+		"\t<?php\n" +
+		"cccc 2 5 1\n" +
+		"author Carol\n" +
+		"committer-time 1650000000\n" +
+		"filename a.php\n" +
+		"\th();\n"
+
+	lines, err := parseBlamePorcelain([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, info := range lines {
+		if info == nil {
+			have = append(have, "")
+			continue
+		}
+		have = append(have, info.commit)
+	}
+	want := []string{"aaaa", "", "bbbb", "", "cccc"}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("blame lines mismatch (-want +have):\n%s", diff)
+	}
+
+	f := &fileBlame{lines: lines}
+	if got := f.matchBlame(match{line: 2, endLine: 2}); got.commit != "" {
+		t.Errorf("line without an entry: expected empty blame, got %s", got.commit)
+	}
+	if got := f.matchBlame(match{line: 4, endLine: 5}); got.commit != "cccc" {
+		t.Errorf("multi-line match: expected cccc, got %s", got.commit)
+	}
+
+	if _, err := parseBlamePorcelain([]byte("aaaa 1 x 1\n\tf();\n")); err == nil {
+		t.Errorf("expected an error for the bad final line number")
+	}
+}
@@ -0,0 +1,182 @@
+package phpgrep
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cacheVersion should be incremented every time the match results
+// can change for the same inputs (e.g. after the noverify update).
+const cacheVersion = "2"
+
+// resultsCache is an on-disk storage for the per-file match results.
+//
+// Every entry is keyed by the file contents hash plus the hash of
+// everything that can affect the results (pattern, filters and flags),
+// so the unchanged files don't need to be parsed at all.
+type resultsCache struct {
+	dir        string
+	configHash []byte
+}
+
+// matchRecord is a serializable match representation.
+type matchRecord struct {
+	Text             string          `json:"text"`
+	MatchStartOffset int             `json:"match_start_offset"`
+	MatchLength      int             `json:"match_length"`
+	Line             int             `json:"line"`
+	EndLine          int             `json:"end_line"`
+	StartPos         int             `json:"start_pos"`
+	EndPos           int             `json:"end_pos"`
+	Captures         []captureRecord `json:"captures,omitempty"`
+}
+
+type captureRecord struct {
+	Name     string `json:"name"`
+	StartPos int    `json:"start_pos"`
+	EndPos   int    `json:"end_pos"`
+}
+
+func newResultsCache(dir string, config ...string) (*resultsCache, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("create cache dir: %v", err)
+	}
+	return &resultsCache{dir: dir, configHash: cacheConfigHash(cacheVersion, config)}, nil
+}
+
+func cacheConfigHash(version string, config []string) []byte {
+	h := sha256.New()
+	h.Write([]byte(version))
+	for _, s := range config {
+		// Write the length as well, so ("ab", "c") and ("a", "bc") hashes differ.
+		h.Write([]byte(strconv.Itoa(len(s))))
+		h.Write([]byte(s))
+	}
+	return h.Sum(nil)
+}
+
+// cacheConfig returns everything besides the file that can affect the match results.
+func (p *program) cacheConfig(needMatchData, needMatchLine bool) []string {
+	return []string{
+		p.args.pattern,
+		strings.Join(p.args.filters, "\n"),
+		strconv.FormatBool(p.args.caseSensitive),
+		strconv.FormatBool(p.args.strictSyntax),
+		strconv.FormatBool(needMatchData),
+		strconv.FormatBool(needMatchLine),
+	}
+}
+
+func (c *resultsCache) key(filename string, data []byte, excludedLines []int, changedLines []lineRange) string {
+	h := sha256.New()
+	h.Write(c.configHash)
+	h.Write([]byte(filename))
+	h.Write([]byte{0})
+	for _, line := range excludedLines {
+		h.Write([]byte(strconv.Itoa(line) + ","))
+	}
+	h.Write([]byte{0})
+	for _, r := range changedLines {
+		h.Write([]byte(strconv.Itoa(r.from) + "-" + strconv.Itoa(r.to) + ","))
+	}
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *resultsCache) entryPath(key string) string {
+	return filepath.Join(c.dir, key[:2], key[2:]+".json")
+}
+
+func (c *resultsCache) load(key, filename string) ([]match, bool) {
+	data, err := ioutil.ReadFile(c.entryPath(key))
+	if err != nil {
+		return nil, false
+	}
+	var records []matchRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		// Corrupted entry, it will be overwritten.
+		return nil, false
+	}
+	matches := make([]match, len(records))
+	for i, r := range records {
+		matches[i] = r.toMatch(filename)
+	}
+	return matches, true
+}
+
+func (c *resultsCache) store(key string, matches []match) error {
+	records := make([]matchRecord, len(matches))
+	for i, m := range matches {
+		records[i] = newMatchRecord(m)
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	entryPath := c.entryPath(key)
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0777); err != nil {
+		return err
+	}
+	return writeFileAtomic(entryPath, data)
+}
+
+// writeFileAtomic writes to a temporary file first and then renames it,
+// so nobody ever observes a partially written file.
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+func newMatchRecord(m match) matchRecord {
+	r := matchRecord{
+		Text:             m.text,
+		MatchStartOffset: m.matchStartOffset,
+		MatchLength:      m.matchLength,
+		Line:             m.line,
+		EndLine:          m.endLine,
+		StartPos:         m.startPos,
+		EndPos:           m.endPos,
+	}
+	for _, c := range m.captures {
+		r.Captures = append(r.Captures, captureRecord{Name: c.name, StartPos: c.startPos, EndPos: c.endPos})
+	}
+	return r
+}
+
+func (r matchRecord) toMatch(filename string) match {
+	m := match{
+		text:             r.Text,
+		matchStartOffset: r.MatchStartOffset,
+		matchLength:      r.MatchLength,
+		filename:         filename,
+		line:             r.Line,
+		endLine:          r.EndLine,
+		startPos:         r.StartPos,
+		endPos:           r.EndPos,
+	}
+	for _, c := range r.Captures {
+		m.captures = append(m.captures, capture{name: c.Name, startPos: c.StartPos, endPos: c.EndPos})
+	}
+	return m
+}
@@ -0,0 +1,144 @@
+package phpgrep
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResultsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := []string{"f($x)", "x=1", "false", "false", "true", "true"}
+	c, err := newResultsCache(dir, config...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("<?php\nf(1);\nf(1);\n")
+	key := c.key("a.php", data, nil, nil)
+
+	if _, ok := c.load(key, "a.php"); ok {
+		t.Fatalf("the empty cache has an entry")
+	}
+
+	matches := []match{
+		{
+			text:        "f(1);",
+			matchLength: 4,
+			filename:    "a.php",
+			line:        2,
+			endLine:     2,
+			startPos:    6,
+			endPos:      10,
+			captures:    []capture{{name: "x", startPos: 8, endPos: 9}},
+		},
+		{text: "f(1);", matchLength: 4, filename: "a.php", line: 3, endLine: 3, startPos: 12, endPos: 16},
+	}
+	if err := c.store(key, matches); err != nil {
+		t.Fatal(err)
+	}
+	have, ok := c.load(key, "a.php")
+	if !ok {
+		t.Fatalf("stored entry is not loaded")
+	}
+	if diff := cmp.Diff(matches, have, cmp.AllowUnexported(match{}, capture{})); diff != "" {
+		t.Errorf("loaded matches mismatch (-want +have):\n%s", diff)
+	}
+
+	// A file without matches is cached too.
+	emptyKey := c.key("b.php", []byte("<?php\n"), nil, nil)
+	if err := c.store(emptyKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	if have, ok := c.load(emptyKey, "b.php"); !ok || len(have) != 0 {
+		t.Errorf("empty entry: have %v (ok=%v), want no matches", have, ok)
+	}
+
+	// The other cache version doesn't see the entries.
+	old := &resultsCache{dir: dir, configHash: cacheConfigHash("1", config)}
+	if _, ok := old.load(old.key("a.php", data, nil, nil), "a.php"); ok {
+		t.Errorf("the entry is loaded by the other cache version")
+	}
+
+	// The corrupted entry is a cache miss, it's overwritten by the next store.
+	if err := ioutil.WriteFile(c.entryPath(key), []byte(`[{"text":`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.load(key, "a.php"); ok {
+		t.Errorf("the corrupted entry is loaded")
+	}
+	if err := c.store(key, matches[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if have, ok := c.load(key, "a.php"); !ok || len(have) != 1 {
+		t.Errorf("overwritten entry: have %v (ok=%v), want 1 match", have, ok)
+	}
+}
+
+func TestResultsCacheKey(t *testing.T) {
+	base := arguments{
+		pattern: "f($x)",
+		filters: []string{"x=1"},
+		workers: 4,
+	}
+	data := []byte("<?php\nf(1);\n")
+	keyOf := func(args arguments, needMatchData, needMatchLine bool, filename string, data []byte, excludedLines []int, changedLines []lineRange) string {
+		p := &program{args: args}
+		c := &resultsCache{configHash: cacheConfigHash(cacheVersion, p.cacheConfig(needMatchData, needMatchLine))}
+		return c.key(filename, data, excludedLines, changedLines)
+	}
+	baseKey := keyOf(base, false, false, "a.php", data, nil, nil)
+
+	tests := []struct {
+		name          string
+		modify        func(args *arguments)
+		needMatchData bool
+		needMatchLine bool
+		filename      string
+		data          string
+		excludedLines []int
+		changedLines  []lineRange
+		changed       bool
+	}{
+		{name: "same"},
+		{name: "workers", modify: func(args *arguments) { args.workers = 8 }},
+		{name: "limit", modify: func(args *arguments) { args.limit = 10 }},
+		{name: "pattern", modify: func(args *arguments) { args.pattern = "g($x)" }, changed: true},
+		{name: "filters", modify: func(args *arguments) { args.filters = []string{"x=2"} }, changed: true},
+		{name: "filters split", modify: func(args *arguments) { args.filters = []string{"x=", "1"} }, changed: true},
+		{name: "case-sensitive", modify: func(args *arguments) { args.caseSensitive = true }, changed: true},
+		{name: "strict-syntax", modify: func(args *arguments) { args.strictSyntax = true }, changed: true},
+		{name: "match data", needMatchData: true, changed: true},
+		{name: "match line", needMatchLine: true, changed: true},
+		{name: "filename", filename: "b.php", changed: true},
+		{name: "contents", data: "<?php\nf(2);\n", changed: true},
+		{name: "excluded lines", excludedLines: []int{2}, changed: true},
+		{name: "changed lines", changedLines: []lineRange{{from: 2, to: 2}}, changed: true},
+	}
+
+	for _, test := range tests {
+		args := base
+		args.filters = append([]string(nil), base.filters...)
+		if test.modify != nil {
+			test.modify(&args)
+		}
+		filename := "a.php"
+		if test.filename != "" {
+			filename = test.filename
+		}
+		fileData := data
+		if test.data != "" {
+			fileData = []byte(test.data)
+		}
+		key := keyOf(args, test.needMatchData, test.needMatchLine, filename, fileData, test.excludedLines, test.changedLines)
+		if changed := key != baseKey; changed != test.changed {
+			t.Errorf("%s: have key changed=%v, want %v", test.name, changed, test.changed)
+		}
+	}
+}
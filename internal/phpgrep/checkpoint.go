@@ -0,0 +1,210 @@
+package phpgrep
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// checkpoint records the search progress, so an interrupted
+// search can be continued from where it stopped.
+type checkpoint struct {
+	filename string
+	config   string
+
+	// matches are never truncated, so the resumed search
+	// has the same results as the uninterrupted one.
+	mu        sync.Mutex
+	processed []string
+	matches   []match
+	skipped   []skippedFile
+	found     int64
+	dirty     bool
+
+	// skip contains the files processed during the previous runs
+	// and restored is the number of their recorded matches.
+	// They're not modified after the checkpoint is loaded.
+	skip     map[string]bool
+	restored map[string]int
+}
+
+type checkpointData struct {
+	Config    string            `json:"config"`
+	Processed []string          `json:"processed"`
+	Matches   []checkpointMatch `json:"matches"`
+	Skipped   []jsonSkippedFile `json:"skipped,omitempty"`
+	Found     int64             `json:"found"`
+}
+
+type checkpointMatch struct {
+	Filename string `json:"filename"`
+	matchRecord
+}
+
+// checkpointConfig describes everything that can affect the results.
+// Checkpoints can't be shared between different searches.
+func (p *program) checkpointConfig() string {
+	deps := inspectFormatDeps(p.args.format)
+	parts := []string{
+		cacheVersion,
+		p.args.targets,
+		p.args.filesFrom,
+		p.args.diffBase,
+		p.args.diffFile,
+		p.args.pattern,
+		strings.Join(p.args.filters, "\n"),
+		strings.Join(p.args.excludes, "\n"),
+		strings.Join(p.args.includes, "\n"),
+		strconv.FormatBool(p.args.noIgnore),
+		p.args.excludeResults,
+		p.args.phpFileExt,
+		strconv.FormatBool(p.args.sniffPHP),
+		strconv.FormatBool(p.args.markdown),
+		p.args.shard,
+		p.args.sort,
+		p.args.maxFileSize,
+		strconv.FormatBool(p.args.skipGenerated),
+		p.args.generatedMarker,
+		strconv.Itoa(p.args.generatedLineLength),
+		strconv.FormatUint(uint64(p.args.limit), 10),
+		strconv.FormatBool(p.args.caseSensitive),
+		strconv.FormatBool(p.args.strictSyntax),
+		strconv.FormatBool(deps.capture || p.args.tui || p.args.json),
+		strconv.FormatBool(deps.matchLine || p.args.json),
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func (p *program) loadCheckpoint() error {
+	if p.args.checkpoint == "" {
+		return nil
+	}
+
+	c := &checkpoint{
+		filename: p.args.checkpoint,
+		config:   p.checkpointConfig(),
+		skip:     make(map[string]bool),
+		restored: make(map[string]int),
+	}
+	p.checkpoint = c
+
+	data, err := ioutil.ReadFile(c.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved checkpointData
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("decode %s: %v", c.filename, err)
+	}
+	if saved.Config != c.config {
+		return fmt.Errorf("%s was created for a different search, remove it to start from scratch", c.filename)
+	}
+
+	for _, filename := range saved.Processed {
+		c.skip[filename] = true
+	}
+	c.processed = saved.Processed
+	c.found = saved.Found
+
+	// The skipped files of the previous runs are reported as well.
+	for _, f := range saved.Skipped {
+		c.skipped = append(c.skipped, skippedFile{filename: f.Filename, reason: f.Reason})
+		p.skipped.add(f.Filename, f.Reason)
+	}
+
+	// Previously found matches are added as if they were found by the first worker.
+	w := p.workers[0]
+	for _, r := range saved.Matches {
+		m := r.toMatch(r.Filename)
+		c.matches = append(c.matches, m)
+		c.restored[m.filename]++
+		if w.reserveMatch() {
+			w.matches = append(w.matches, m)
+		}
+	}
+	p.matches = saved.Found
+
+	if p.args.verbose {
+		log.Printf("debug: resuming from %s: %d files processed, %d matches found", c.filename, len(c.skip), saved.Found)
+	}
+	return nil
+}
+
+func (c *checkpoint) isProcessed(filename string) bool {
+	return c != nil && c.skip[filename]
+}
+
+// restoredMatches returns the number of the processed file matches.
+func (c *checkpoint) restoredMatches(filename string) int {
+	if c == nil {
+		return 0
+	}
+	return c.restored[filename]
+}
+
+// record marks the file as processed.
+// matches should contain all the file matches and skipped
+// are the skipped files report entries of that file.
+func (c *checkpoint) record(filename string, matches []match, skipped []skippedFile) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.processed = append(c.processed, filename)
+	c.matches = append(c.matches, matches...)
+	c.skipped = append(c.skipped, skipped...)
+	c.found += int64(len(matches))
+	c.dirty = true
+}
+
+func (c *checkpoint) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	saved := checkpointData{
+		Config:    c.config,
+		Processed: c.processed,
+		Matches:   make([]checkpointMatch, len(c.matches)),
+		Found:     c.found,
+	}
+	for i, m := range c.matches {
+		saved.Matches[i] = checkpointMatch{Filename: m.filename, matchRecord: newMatchRecord(m)}
+	}
+	for _, f := range c.skipped {
+		saved.Skipped = append(saved.Skipped, jsonSkippedFile{Filename: f.filename, Reason: f.reason})
+	}
+	data, err := json.Marshal(saved)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.filename, data)
+}
+
+// remove deletes the checkpoint file after the search is finished,
+// so the next run starts from scratch.
+func (c *checkpoint) remove() error {
+	if c == nil {
+		return nil
+	}
+	err := os.Remove(c.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package phpgrep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func newCheckpointTestProgram(args arguments) *program {
+	return &program{
+		args:    args,
+		workers: []*worker{{}},
+		skipped: &skippedFiles{},
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := arguments{
+		targets:    "src",
+		pattern:    "f($_)",
+		format:     defaultFormat,
+		sort:       "path",
+		limit:      1,
+		checkpoint: filepath.Join(dir, "scan.checkpoint"),
+	}
+
+	p := newCheckpointTestProgram(args)
+	if err := p.loadCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	p.checkpoint.record("src/a.php", []match{
+		{filename: "src/a.php", line: 3, startPos: 10, endPos: 14, text: "f(1)", matchLength: 4},
+		{filename: "src/a.php", line: 4, startPos: 16, endPos: 20, text: "f(2)", matchLength: 4},
+	}, nil)
+	p.checkpoint.record("src/big.php", nil, []skippedFile{
+		{filename: "src/big.php", reason: "file size 4096 exceeds --max-file-size"},
+	})
+	p.checkpoint.record("src/doc.md", nil, []skippedFile{
+		{filename: "src/doc.md:7", reason: "code can't be parsed: syntax error"},
+	})
+	if err := p.checkpoint.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := newCheckpointTestProgram(args)
+	if err := resumed.loadCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	c := resumed.checkpoint
+	for _, filename := range []string{"src/a.php", "src/big.php", "src/doc.md"} {
+		if !c.isProcessed(filename) {
+			t.Errorf("%s is not processed after resume", filename)
+		}
+	}
+	if c.isProcessed("src/b.php") {
+		t.Errorf("src/b.php is processed after resume")
+	}
+
+	// All matches are restored, even though the --limit is 1.
+	if n := c.restoredMatches("src/a.php"); n != 2 {
+		t.Errorf("src/a.php: have %d restored matches, want 2", n)
+	}
+	if resumed.matches != 2 {
+		t.Errorf("have %d found matches, want 2", resumed.matches)
+	}
+	var lines []int
+	for _, m := range resumed.workers[0].matches {
+		lines = append(lines, m.line)
+	}
+	if diff := cmp.Diff([]int{3, 4}, lines); diff != "" {
+		t.Errorf("restored matches mismatch (-want +have):\n%s", diff)
+	}
+
+	wantSkipped := []string{
+		"src/big.php: file size 4096 exceeds --max-file-size",
+		"src/doc.md:7: code can't be parsed: syntax error",
+	}
+	var haveSkipped []string
+	for _, f := range resumed.skipped.sorted() {
+		haveSkipped = append(haveSkipped, f.filename+": "+f.reason)
+	}
+	if diff := cmp.Diff(wantSkipped, haveSkipped); diff != "" {
+		t.Errorf("skipped files mismatch (-want +have):\n%s", diff)
+	}
+
+	// The replayed skipped files are saved again with the next checkpoint.
+	c.record("src/b.php", nil, nil)
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+	resumedAgain := newCheckpointTestProgram(args)
+	if err := resumedAgain.loadCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(resumedAgain.skipped.sorted()); n != len(wantSkipped) {
+		t.Errorf("have %d skipped files after the second resume, want %d", n, len(wantSkipped))
+	}
+
+	if err := c.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(args.checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint file is not removed: %v", err)
+	}
+}
+
+func TestCheckpointConfigMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := arguments{
+		targets: "src",
+		pattern: "f($_)",
+		format:  defaultFormat,
+		sort:    "path",
+		limit:   1000,
+		workers: 4,
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(args *arguments)
+		mismatch bool
+	}{
+		{name: "same", modify: func(args *arguments) {}},
+		{name: "workers", modify: func(args *arguments) { args.workers = 8 }},
+		{name: "verbose", modify: func(args *arguments) { args.verbose = true }},
+		{name: "pattern", modify: func(args *arguments) { args.pattern = "g($_)" }, mismatch: true},
+		{name: "targets", modify: func(args *arguments) { args.targets = "src,lib" }, mismatch: true},
+		{name: "filters", modify: func(args *arguments) { args.filters = []string{"x=1"} }, mismatch: true},
+		{name: "limit", modify: func(args *arguments) { args.limit = 10 }, mismatch: true},
+		{name: "exclude", modify: func(args *arguments) { args.excludes = stringList{"vendor/"} }, mismatch: true},
+		{name: "format captures", modify: func(args *arguments) { args.format = "{{.x}}" }, mismatch: true},
+	}
+
+	for _, test := range tests {
+		args := base
+		args.checkpoint = filepath.Join(dir, "scan.checkpoint")
+		p := newCheckpointTestProgram(args)
+		if err := p.loadCheckpoint(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		p.checkpoint.record("src/a.php", nil, nil)
+		if err := p.checkpoint.save(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		test.modify(&args)
+		err := newCheckpointTestProgram(args).loadCheckpoint()
+		if test.mismatch && err == nil {
+			t.Errorf("%s: expected a mismatch error", test.name)
+		}
+		if !test.mismatch && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if err := p.checkpoint.remove(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+}
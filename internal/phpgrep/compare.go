@@ -0,0 +1,384 @@
+package phpgrep
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// comparison is the result of the --compare-rev mode.
+type comparison struct {
+	added     []match
+	removed   []match
+	unchanged int
+}
+
+func (p *program) validateCompareFlags() error {
+	if p.args.compareRev == "" {
+		return nil
+	}
+	if p.args.replace || p.args.tui || p.args.watch || p.args.json {
+		return fmt.Errorf("--compare-rev can't be combined with -i, --tui, --watch or --json")
+	}
+	if p.args.filesFrom != "" || p.args.diffBase != "" || p.args.diffFile != "" {
+		return fmt.Errorf("--compare-rev can't be combined with --files-from, --diff-base or --diff-file")
+	}
+	if countStdinTargets(p.args.targets) != 0 {
+		return fmt.Errorf("--compare-rev can't be used with the stdin target")
+	}
+	// All matches are needed to compare them.
+	if p.args.sort != "path" {
+		return fmt.Errorf("--compare-rev requires --sort path")
+	}
+	return nil
+}
+
+// compareRevision runs the same search for the --compare-rev revision
+// files and compares the results with the working tree matches.
+func (p *program) compareRevision() error {
+	if p.args.compareRev == "" {
+		return nil
+	}
+
+	newMatches := p.collectMatches()
+	for _, w := range p.workers {
+		w.matches = nil
+	}
+	if err := p.grepRevision(p.args.compareRev); err != nil {
+		return err
+	}
+	oldMatches := p.collectMatches()
+
+	p.comparison = compareMatches(oldMatches, newMatches)
+	p.matches = int64(len(p.comparison.added))
+	p.annotateMatches(p.comparison.removed, p.args.compareRev)
+	p.annotateMatches(p.comparison.added, "")
+	return nil
+}
+
+// matchFingerprint identifies the match regardless of its position and formatting,
+// so the matches are not reported as changed when some lines are added above them.
+func matchFingerprint(m match) string {
+	return m.filename + "\x00" + strings.Join(strings.Fields(m.matchText()), "")
+}
+
+// compareMatches compares the matches as multisets of fingerprints.
+// Both slices should be sorted.
+func compareMatches(oldMatches, newMatches []match) *comparison {
+	var result comparison
+
+	oldCounts := make(map[string]int, len(oldMatches))
+	for _, m := range oldMatches {
+		oldCounts[matchFingerprint(m)]++
+	}
+	newCounts := make(map[string]int, len(newMatches))
+	for _, m := range newMatches {
+		newCounts[matchFingerprint(m)]++
+	}
+
+	for _, m := range newMatches {
+		fingerprint := matchFingerprint(m)
+		if oldCounts[fingerprint] > 0 {
+			oldCounts[fingerprint]--
+			result.unchanged++
+			continue
+		}
+		result.added = append(result.added, m)
+	}
+	for _, m := range oldMatches {
+		fingerprint := matchFingerprint(m)
+		if newCounts[fingerprint] > 0 {
+			newCounts[fingerprint]--
+			continue
+		}
+		result.removed = append(result.removed, m)
+	}
+	return &result
+}
+
+func (p *program) printComparison() error {
+	c := p.comparison
+
+	// Removed and added matches are grouped by file.
+	printed := uint(0)
+	i, j := 0, 0
+	for i < len(c.removed) || j < len(c.added) {
+		if printed >= p.args.limit {
+			break
+		}
+		prefix := "+ "
+		var m match
+		if j == len(c.added) || (i < len(c.removed) && c.removed[i].filename <= c.added[j].filename) {
+			prefix = "- "
+			m = c.removed[i]
+			i++
+		} else {
+			m = c.added[j]
+			j++
+		}
+		s, err := formatMatch(p.outputTemplate, &p.args, m)
+		if err != nil {
+			return err
+		}
+		fmt.Println(prefix + s)
+		printed++
+	}
+
+	if total := uint(len(c.added) + len(c.removed)); total > printed {
+		log.Printf("results limited to %d changes (%d truncated)", printed, total-printed)
+	}
+	log.Printf("compared to %s: %d added, %d removed, %d unchanged matches",
+		p.args.compareRev, len(c.added), len(c.removed), c.unchanged)
+	return nil
+}
+
+// grepRevision searches the files from the git revision.
+// The files are read with git, so the working tree is not modified.
+func (p *program) grepRevision(rev string) error {
+	filenames, err := p.listRevisionFiles(rev)
+	if err != nil {
+		return err
+	}
+
+	fileQueue := make(chan fileContents, len(p.workers))
+	var wg sync.WaitGroup
+	wg.Add(len(p.workers))
+	for _, w := range p.workers {
+		go func(w *worker) {
+			defer wg.Done()
+			for f := range fileQueue {
+				if _, err := w.grepData(f.filename, f.data); err != nil {
+					log.Printf("error: %s:%s: %v", rev, f.filename, err)
+				}
+			}
+		}(w)
+	}
+
+	err = readRevisionFiles(rev, filenames, func(f fileContents) {
+		fileQueue <- f
+	})
+	close(fileQueue)
+	wg.Wait()
+	return err
+}
+
+// listRevisionFiles returns the revision files that are located inside the targets.
+// The file names are relative to the current directory.
+func (p *program) listRevisionFiles(rev string) ([]string, error) {
+	args := []string{"ls-tree", "-r", "-z", "--name-only", rev, "--"}
+	for _, target := range strings.Split(p.args.targets, ",") {
+		args = append(args, strings.TrimSpace(target))
+	}
+	out, err := runGit(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var ignore *revisionIgnore
+	if !p.args.noIgnore {
+		ignore = newRevisionIgnore(p.args.targets)
+	}
+	var filenames []string
+	for _, filename := range strings.Split(string(out), "\x00") {
+		// The batch protocol is line-based.
+		if filename == "" || strings.Contains(filename, "\n") {
+			continue
+		}
+		if ignore.isIgnored(filename) {
+			p.stats.countSkippedIgnore()
+			continue
+		}
+		if p.acceptListedFile(filename) {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+// revisionIgnore applies the working tree ignore files to the revision files,
+// so both searches skip the same files. Like with walkTargets, the rules of
+// the target parent directories are used and the explicitly passed files are never ignored.
+type revisionIgnore struct {
+	targets []string
+	dirs    map[string]revisionIgnoreDir
+}
+
+type revisionIgnoreDir struct {
+	// matcher is used for the directory entries, it includes the directory own ignore files.
+	matcher *ignoreMatcher
+	ignored bool
+}
+
+func newRevisionIgnore(targets string) *revisionIgnore {
+	r := &revisionIgnore{dirs: make(map[string]revisionIgnoreDir)}
+	for _, target := range strings.Split(targets, ",") {
+		target = filepath.ToSlash(filepath.Clean(strings.TrimSpace(target)))
+		info, err := os.Stat(target)
+		if err == nil && !info.IsDir() {
+			continue
+		}
+		// The targets that are removed from the working tree are directories too.
+		r.targets = append(r.targets, target)
+	}
+	return r
+}
+
+// isIgnored reports whether the slash-separated path relative
+// to the current directory would be skipped by the walkTargets.
+func (r *revisionIgnore) isIgnored(filename string) bool {
+	if r == nil {
+		return false
+	}
+	for _, target := range r.targets {
+		if target != "." && !strings.HasPrefix(filename, target+"/") {
+			continue
+		}
+		dir, name := path.Split(filename)
+		dir = strings.TrimSuffix(dir, "/")
+		if dir == "" {
+			dir = "."
+		}
+		d := r.dir(target, dir)
+		return d.ignored || d.matcher.isIgnored(name, false)
+	}
+	return false
+}
+
+// dir returns the ignore state of the dir that is located inside the target.
+func (r *revisionIgnore) dir(target, dir string) revisionIgnoreDir {
+	if d, ok := r.dirs[dir]; ok {
+		return d
+	}
+
+	var d revisionIgnoreDir
+	if dir == target {
+		m, err := targetIgnoreMatcher(filepath.FromSlash(target))
+		if err != nil {
+			log.Printf("error: %s ignore files: %v", target, err)
+		}
+		d.matcher = loadIgnoreRules(m, filepath.FromSlash(dir), func(name string) bool {
+			return fileExists(filepath.Join(filepath.FromSlash(dir), name))
+		})
+	} else {
+		parentDir, name := path.Split(dir)
+		parentDir = strings.TrimSuffix(parentDir, "/")
+		if parentDir == "" {
+			parentDir = "."
+		}
+		parent := r.dir(target, parentDir)
+		switch {
+		case parent.ignored || parent.matcher.isIgnored(name, true):
+			d.ignored = true
+		case name == ".git":
+			d.ignored = true
+		default:
+			d.matcher = loadIgnoreRules(parent.matcher.child(name), filepath.FromSlash(dir), func(entry string) bool {
+				return fileExists(filepath.Join(filepath.FromSlash(dir), entry))
+			})
+		}
+	}
+	r.dirs[dir] = d
+	return d
+}
+
+// readRevisionFiles reads the revision files contents with a single
+// git cat-file process and passes them to the fn one by one.
+func readRevisionFiles(rev string, filenames []string, fn func(f fileContents)) error {
+	cmd := exec.Command("git", "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Requests are written concurrently, so the pipes never deadlock.
+	go func() {
+		w := bufio.NewWriter(stdin)
+		for _, filename := range filenames {
+			// "./" makes the path relative to the current directory.
+			fmt.Fprintf(w, "%s:./%s\n", rev, filename)
+		}
+		w.Flush()
+		stdin.Close()
+	}()
+
+	r := bufio.NewReader(stdout)
+	var readErr error
+	for _, filename := range filenames {
+		data, err := readBatchObject(r)
+		if err != nil {
+			readErr = fmt.Errorf("read %s:%s: %v", rev, filename, err)
+			break
+		}
+		if data != nil {
+			fn(fileContents{filename: filename, data: data})
+		}
+	}
+	if readErr != nil {
+		// Unblock the git process, so it can exit.
+		io.Copy(ioutil.Discard, r)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git cat-file: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return readErr
+}
+
+// readBatchObject reads a single git cat-file --batch response.
+// It returns nil data for the missing objects.
+func readBatchObject(r *bufio.Reader) ([]byte, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(header)
+	if len(fields) == 2 && fields[1] == "missing" {
+		return nil, nil
+	}
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("unexpected header: %q", header)
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected header: %q", header)
+	}
+	data := make([]byte, size+1) // Object contents are followed by a newline
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if fields[1] != "blob" {
+		return nil, nil
+	}
+	return data[:size], nil
+}
+
+func runGit(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,115 @@
+package phpgrep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareMatches(t *testing.T) {
+	newMatch := func(filename string, line int, text string) match {
+		return match{filename: filename, line: line, text: text, matchLength: len(text)}
+	}
+
+	oldMatches := []match{
+		newMatch("a.php", 3, "f(1)"),
+		newMatch("a.php", 5, "f(2)"),
+		newMatch("a.php", 7, "f(2)"),
+		newMatch("b.php", 1, "f($x)"),
+	}
+	newMatches := []match{
+		// Shifted by the lines added above, but not changed.
+		newMatch("a.php", 10, "f(1)"),
+		newMatch("a.php", 12, "f(2)"),
+		// Reformatted, but not changed.
+		newMatch("b.php", 1, "f(\n  $x\n)"),
+		newMatch("c.php", 1, "f(3)"),
+	}
+
+	c := compareMatches(oldMatches, newMatches)
+	if c.unchanged != 3 {
+		t.Errorf("unchanged: have %d, want 3", c.unchanged)
+	}
+	if len(c.added) != 1 || c.added[0].filename != "c.php" {
+		t.Errorf("added: have %+v, want c.php:1", c.added)
+	}
+	if len(c.removed) != 1 || c.removed[0].line != 7 {
+		t.Errorf("removed: have %+v, want a.php:7", c.removed)
+	}
+}
+
+func TestRevisionIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".git/HEAD":          "ref: refs/heads/main\n",
+		".gitignore":         "gen/\n*.tpl.php\n",
+		"src/.gitignore":     "local.php\n",
+		"src/a.php":          "<?php\n",
+		"src/nested/b.php":   "<?php\n",
+		"src/view.tpl.php":   "<?php\n",
+		"src/gen/c.php":      "<?php\n",
+		"other/local.php":    "<?php\n",
+		"other/view.tpl.php": "<?php\n",
+	}
+	for filename, contents := range files {
+		filename = filepath.Join(dir, filepath.FromSlash(filename))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	tests := []struct {
+		targets  string
+		filename string
+		ignored  bool
+	}{
+		{targets: ".", filename: "src/a.php"},
+		{targets: ".", filename: "src/nested/b.php"},
+		{targets: ".", filename: "src/view.tpl.php", ignored: true},
+		{targets: ".", filename: "src/gen/c.php", ignored: true},
+		{targets: ".", filename: "src/local.php", ignored: true},
+		{targets: ".", filename: "other/local.php"},
+		{targets: ".", filename: "other/view.tpl.php", ignored: true},
+		// The directories that only exist in the revision.
+		{targets: ".", filename: "src/gen/removed/d.php", ignored: true},
+		{targets: ".", filename: "removed/e.php"},
+		{targets: ".", filename: "removed/e.tpl.php", ignored: true},
+		// The parent directory ignore files are used for the nested targets.
+		{targets: "src", filename: "src/view.tpl.php", ignored: true},
+		{targets: "src/nested", filename: "src/nested/local.php", ignored: true},
+		// Explicitly passed files are never ignored.
+		{targets: "src/view.tpl.php", filename: "src/view.tpl.php"},
+		{targets: "src/view.tpl.php,other", filename: "src/view.tpl.php"},
+		{targets: "src/view.tpl.php,other", filename: "other/view.tpl.php", ignored: true},
+	}
+
+	for _, test := range tests {
+		r := newRevisionIgnore(test.targets)
+		if have := r.isIgnored(test.filename); have != test.ignored {
+			t.Errorf("targets=%s %s: have ignored=%v, want %v", test.targets, test.filename, have, test.ignored)
+		}
+	}
+
+	var r *revisionIgnore
+	if r.isIgnored("src/view.tpl.php") {
+		t.Errorf("nil revisionIgnore ignores files")
+	}
+}
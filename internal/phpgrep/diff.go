@@ -0,0 +1,257 @@
+package phpgrep
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lineRange is an inclusive range of line numbers.
+type lineRange struct {
+	from int
+	to   int
+}
+
+// diffFilter restricts the search to the lines added by a diff.
+type diffFilter struct {
+	// files maps the changed file names (as they're written in the diff)
+	// to the sorted added line ranges.
+	files map[string][]lineRange
+}
+
+func (p *program) loadDiff() error {
+	var data []byte
+	switch {
+	case p.args.diffBase != "":
+		// Working tree is compared to the base revision.
+		// --relative makes the paths relative to the current directory,
+		// the same way the targets are.
+		out, err := runGit("diff", "--no-color", "--no-ext-diff", "--relative",
+			"--src-prefix=a/", "--dst-prefix=b/", "-U0", p.args.diffBase, "--")
+		if err != nil {
+			return err
+		}
+		data = out
+	case p.args.diffFile != "":
+		var err error
+		if p.args.diffFile == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(p.args.diffFile)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	files, err := parseUnifiedDiff(data)
+	if err != nil {
+		return fmt.Errorf("parse diff: %v", err)
+	}
+	p.diff = &diffFilter{files: files}
+	if p.args.verbose {
+		log.Printf("debug: diff contains %d changed files", len(files))
+	}
+	return nil
+}
+
+// parseUnifiedDiff returns the added line ranges for every file in the diff.
+// Deleted files and files without added lines are not included.
+func parseUnifiedDiff(data []byte) (map[string][]lineRange, error) {
+	files := make(map[string][]lineRange)
+
+	var filename string
+	var prevLine string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 16*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "+++ ") && strings.HasPrefix(prevLine, "--- "):
+			var err error
+			filename, err = parseDiffFilename(strings.TrimPrefix(line, "+++ "))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+
+		case strings.HasPrefix(line, "@@ "):
+			oldCount, newStart, newCount, err := parseHunkHeader(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			// The hunk body is consumed right away, so its lines
+			// can't be confused with the file headers.
+			newLine := newStart
+			for oldCount > 0 || newCount > 0 {
+				if !scanner.Scan() {
+					return nil, fmt.Errorf("line %d: unexpected end of hunk", lineNum)
+				}
+				lineNum++
+				hunkLine := scanner.Text()
+				switch {
+				case strings.HasPrefix(hunkLine, "+"):
+					if filename != "" {
+						files[filename] = addChangedLine(files[filename], newLine)
+					}
+					newLine++
+					newCount--
+				case strings.HasPrefix(hunkLine, "-"):
+					oldCount--
+				case strings.HasPrefix(hunkLine, `\`):
+					// "\ No newline at end of file".
+				default:
+					// Context line. Some tools strip the leading space of the empty lines.
+					newLine++
+					oldCount--
+					newCount--
+				}
+			}
+		}
+		prevLine = line
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// parseDiffFilename parses the "+++" line file name.
+// It returns an empty string for the deleted files.
+func parseDiffFilename(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		// Git quotes the names with special characters.
+		end := strings.LastIndexByte(s, '"')
+		unquoted, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("bad file name %s: %v", s, err)
+		}
+		s = unquoted
+	} else if i := strings.IndexByte(s, '\t'); i != -1 {
+		// diff -u adds the timestamp after a tab.
+		s = s[:i]
+	}
+	if s == "/dev/null" {
+		return "", nil
+	}
+	return filepath.Clean(strings.TrimPrefix(s, "b/")), nil
+}
+
+// parseHunkHeader parses the "@@ -l,s +l,s @@" line.
+func parseHunkHeader(line string) (oldCount, newStart, newCount int, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return 0, 0, 0, fmt.Errorf("bad hunk header: %s", line)
+	}
+	_, oldCount, err = parseHunkRange(fields[1][1:])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("bad hunk header: %s", line)
+	}
+	newStart, newCount, err = parseHunkRange(fields[2][1:])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("bad hunk header: %s", line)
+	}
+	return oldCount, newStart, newCount, nil
+}
+
+func parseHunkRange(s string) (start, count int, err error) {
+	count = 1
+	if i := strings.IndexByte(s, ','); i != -1 {
+		count, err = strconv.Atoi(s[i+1:])
+		if err != nil {
+			return 0, 0, err
+		}
+		s = s[:i]
+	}
+	start, err = strconv.Atoi(s)
+	return start, count, err
+}
+
+func addChangedLine(ranges []lineRange, line int) []lineRange {
+	if len(ranges) != 0 && ranges[len(ranges)-1].to == line-1 {
+		ranges[len(ranges)-1].to = line
+		return ranges
+	}
+	return append(ranges, lineRange{from: line, to: line})
+}
+
+// intersects reports whether the lines [from, to] contain any added line.
+func (d *diffFilter) intersects(filename string, from, to int) bool {
+	ranges := d.files[filename]
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].to >= from
+	})
+	return i < len(ranges) && ranges[i].from <= to
+}
+
+// walkChangedFiles sends the changed files that are located inside the targets.
+// Unlike the walkTargets, the directories are not walked at all.
+func (p *program) walkChangedFiles(filenames chan<- string, stop <-chan struct{}) error {
+	var targets []string
+	for _, target := range strings.Split(p.args.targets, ",") {
+		target = strings.TrimSpace(target)
+		if target == stdinTarget {
+			continue
+		}
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, abs)
+	}
+
+	changed := make([]string, 0, len(p.diff.files))
+	for filename := range p.diff.files {
+		changed = append(changed, filename)
+	}
+	sort.Strings(changed)
+
+	for _, filename := range changed {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			return err
+		}
+		inTargets := false
+		for _, target := range targets {
+			if abs == target || strings.HasPrefix(abs, target+string(filepath.Separator)) {
+				inTargets = true
+				break
+			}
+		}
+		if !inTargets || !p.acceptListedFile(filename) {
+			continue
+		}
+		select {
+		case filenames <- filename:
+		case <-stop:
+			return nil
+		}
+	}
+	return nil
+}
+
+// onChangedLines reports whether the match lines [line, endLine]
+// touch the added lines. Without a diff, all lines are accepted.
+func (w *worker) onChangedLines(filename string, line, endLine int) bool {
+	return w.diff == nil || w.diff.intersects(filename, line, endLine)
+}
+
+// changedLines returns the file added lines, they're a part of the cache key
+// since the cached results are restricted to them.
+func (w *worker) changedLines(filename string) []lineRange {
+	if w.diff == nil {
+		return nil
+	}
+	return w.diff.files[filename]
+}
@@ -0,0 +1,151 @@
+package phpgrep
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseUnifiedDiff(t *testing.T) {
+	diff := `diff --git a/src/a.php b/src/a.php
+index 1111111..2222222 100644
+--- a/src/a.php
++++ b/src/a.php
+@@ -3,0 +4,2 @@ function f() {
++    g();
++    h();
+@@ -10 +12 @@ function f() {
+-    old();
++    new();
+@@ -20,3 +22,4 @@
+ context();
+--- removed line that looks like a header
++++ added line that looks like a header
+ context();
++added();
+diff --git a/src/removed.php b/src/removed.php
+deleted file mode 100644
+--- a/src/removed.php
++++ /dev/null
+@@ -1,2 +0,0 @@
+-<?php
+-f();
+diff --git a/src/b.php b/src/b.php
+--- a/src/b.php
++++ b/src/b.php
+@@ -1,2 +1,2 @@
+ <?php
+-f();
+\ No newline at end of file
++f();
+\ No newline at end of file
+--- "b/src/with space.php"	2022-01-01
++++ "b/src/with space.php"	2022-01-01
+@@ -0,0 +1 @@
++<?php
+`
+	files, err := parseUnifiedDiff([]byte(diff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]lineRange{
+		"src/a.php":          {{4, 5}, {12, 12}, {23, 23}, {25, 25}},
+		"src/b.php":          {{2, 2}},
+		"src/with space.php": {{1, 1}},
+	}
+	if diff := cmp.Diff(want, files, cmp.AllowUnexported(lineRange{})); diff != "" {
+		t.Errorf("(-want +have):\n%s", diff)
+	}
+
+	d := &diffFilter{files: files}
+	intersectTests := []struct {
+		from, to int
+		want     bool
+	}{
+		{1, 3, false},
+		{1, 4, true},
+		{5, 11, true},
+		{6, 11, false},
+		{12, 12, true},
+		{13, 22, false},
+		{24, 24, false},
+		{20, 30, true},
+	}
+	for _, test := range intersectTests {
+		have := d.intersects("src/a.php", test.from, test.to)
+		if have != test.want {
+			t.Errorf("intersects(%d, %d): have %v, want %v", test.from, test.to, have, test.want)
+		}
+	}
+	if d.intersects("src/c.php", 1, 100) {
+		t.Errorf("unchanged file lines should not intersect")
+	}
+}
+
+func TestChangedLinesLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := newResultsCache(dir, "f($x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &diffFilter{
+		files: map[string][]lineRange{
+			"a.php": {{from: 6, to: 6}},
+			"b.php": {{from: 3, to: 3}},
+		},
+	}
+	newMatch := func(filename string, line int) match {
+		return match{filename: filename, line: line, endLine: line, text: "f()", matchLength: 3}
+	}
+	// The cached matches are used, so the files are not parsed.
+	files := []struct {
+		filename string
+		data     []byte
+		matches  []match
+	}{
+		{
+			// More than --limit matches, none of them are on the changed lines.
+			filename: "a.php",
+			data:     []byte("<?php\n\nf(1);\nf(2);\nf(3);\n$x = 1;\n"),
+			matches:  []match{newMatch("a.php", 3), newMatch("a.php", 4), newMatch("a.php", 5)},
+		},
+		{
+			filename: "b.php",
+			data:     []byte("<?php\n\nf(4);\n"),
+			matches:  []match{newMatch("b.php", 3)},
+		},
+	}
+	for _, f := range files {
+		key := c.key(f.filename, f.data, nil, d.files[f.filename])
+		if err := c.store(key, f.matches); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	limit := &matchLimit{max: 2}
+	w := &worker{cache: c, diff: d, limit: limit}
+	var found []int
+	for _, f := range files {
+		n, err := w.grepData(f.filename, f.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, n)
+	}
+	if diff := cmp.Diff([]int{0, 1}, found); diff != "" {
+		t.Errorf("matches per file mismatch (-want +have):\n%s", diff)
+	}
+	if w.stopped || limit.reached() {
+		t.Errorf("the search is stopped by the unchanged lines matches")
+	}
+	if len(w.matches) != 1 || w.matches[0].filename != "b.php" {
+		t.Errorf("have %+v matches, want the b.php match", w.matches)
+	}
+}
@@ -0,0 +1,99 @@
+package phpgrep
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileListPeekSize is the number of bytes that are inspected
+// to decide whether a file list is NUL-separated.
+const fileListPeekSize = 64 * 1024
+
+// walkFiles sends all files to be searched to the filenames channel.
+// The files are taken from the diff, the --files-from list or from the targets.
+func (p *program) walkFiles(filenames chan<- string, stop <-chan struct{}) error {
+	if p.diff != nil {
+		return p.walkChangedFiles(filenames, stop)
+	}
+	if p.args.filesFrom == "" {
+		return p.walkTargets(p.args.targets, filenames, stop)
+	}
+
+	if p.args.filesFrom == "-" {
+		return p.readFileList(os.Stdin, filenames, stop)
+	}
+	f, err := os.Open(p.args.filesFrom)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.readFileList(f, filenames, stop)
+}
+
+// readFileList reads a newline or NUL-separated list of file names.
+// If there is a NUL byte somewhere near the list beginning,
+// the newlines are considered to be a part of the file names.
+//
+// Unlike the targets, the listed files are not checked against the ignore files,
+// but the --exclude, --include and extension checks are still performed.
+func (p *program) readFileList(r io.Reader, filenames chan<- string, stop <-chan struct{}) error {
+	br := bufio.NewReaderSize(r, fileListPeekSize)
+	head, err := br.Peek(fileListPeekSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	sep := byte('\n')
+	if bytes.IndexByte(head, 0) != -1 {
+		sep = 0
+	}
+
+	for {
+		line, err := br.ReadString(sep)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		filename := strings.TrimSuffix(line, string(sep))
+		if sep == '\n' {
+			filename = strings.TrimSuffix(filename, "\r")
+		}
+		if filename != "" && p.acceptListedFile(filename) {
+			select {
+			case filenames <- filename:
+			case <-stop:
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (p *program) acceptListedFile(filename string) bool {
+	p.stats.countWalked()
+	path := &walkedPath{
+		path: filename,
+		rel:  filepath.ToSlash(filepath.Clean(filename)),
+	}
+	if p.isExcluded(path) {
+		p.stats.countSkippedExclude()
+		return false
+	}
+	if !p.isSearchedFile(filename, filepath.Base(filename)) {
+		p.stats.countSkippedExtension()
+		return false
+	}
+	if !p.isIncluded(path) {
+		p.stats.countSkippedExclude()
+		return false
+	}
+	if !p.inShard(path.rel) {
+		p.stats.countSkippedShard()
+		return false
+	}
+	return true
+}
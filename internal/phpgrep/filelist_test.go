@@ -0,0 +1,46 @@
+package phpgrep
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadFileList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{list: "a.php\nb.inc\n", want: []string{"a.php", "b.inc"}},
+		{list: "a.php\r\n\r\nb.php", want: []string{"a.php", "b.php"}},
+		{list: "a.php\x00with\nnewline.php\x00", want: []string{"a.php", "with\nnewline.php"}},
+		{list: "a.php\nREADME.md\nvendor/c.php\n", want: []string{"a.php"}},
+		{list: "", want: nil},
+	}
+
+	for _, test := range tests {
+		p := &program{
+			args: arguments{phpFileExtList: []string{".php", ".inc"}},
+		}
+		f, err := compilePathFilter("glob:vendor/**", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.excludes = append(p.excludes, f)
+
+		filenames := make(chan string, 10)
+		if err := p.readFileList(strings.NewReader(test.list), filenames, nil); err != nil {
+			t.Errorf("read %q: %v", test.list, err)
+			continue
+		}
+		close(filenames)
+		var have []string
+		for filename := range filenames {
+			have = append(have, filename)
+		}
+		if diff := cmp.Diff(test.want, have); diff != "" {
+			t.Errorf("read %q: (-want +have):\n%s", test.list, diff)
+		}
+	}
+}
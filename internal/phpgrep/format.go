@@ -1,16 +1,47 @@
 package phpgrep
 
 import (
+	"fmt"
+	"regexp"
 	"text/template/parse"
 )
 
+// annotationFields are the format fields that are set from the match
+// annotations, they would shadow the pattern captures with the same names.
+var annotationFields = map[string]bool{
+	"Author":     true,
+	"Commit":     true,
+	"AuthorDate": true,
+	"Owners":     true,
+}
+
+// patternCaptureRegexp matches the $x and ${"x:kind"} pattern variables.
+var patternCaptureRegexp = regexp.MustCompile(`\$(?:\{["'](\w+)|(\w+))`)
+
 type formatDeps struct {
 	capture   bool
 	matchLine bool
+	blame     bool
+	owners    bool
+
+	// annotations are the annotationFields that are used by the format.
+	annotations map[string]bool
+}
+
+// checkCaptureNames reports the pattern captures that can't be
+// printed since the format uses the annotation fields with the same names.
+func checkCaptureNames(pattern string, deps formatDeps) error {
+	for _, m := range patternCaptureRegexp.FindAllStringSubmatch(pattern, -1) {
+		name := m[1] + m[2]
+		if deps.annotations[name] {
+			return fmt.Errorf("$%s capture clashes with the {{.%s}} format field, rename the capture", name, name)
+		}
+	}
+	return nil
 }
 
 func inspectFormatDeps(format string) formatDeps {
-	var deps formatDeps
+	deps := formatDeps{annotations: make(map[string]bool)}
 
 	treeMap, err := parse.Parse("output-format", format, "", "", nil)
 	if err != nil {
@@ -31,6 +62,10 @@ func inspectFormatDeps(format string) formatDeps {
 			switch n.Ident[0] {
 			case "Filename", "Line", "Match", "MatchLine":
 				// No need to track these.
+			case "Author", "Commit", "AuthorDate":
+				deps.blame = true
+			case "Owners":
+				deps.owners = true
 			default:
 				deps.capture = true
 			}
@@ -39,6 +74,9 @@ func inspectFormatDeps(format string) formatDeps {
 			case "MatchLine":
 				deps.matchLine = true
 			}
+			if annotationFields[n.Ident[0]] {
+				deps.annotations[n.Ident[0]] = true
+			}
 		}
 		return true
 	})
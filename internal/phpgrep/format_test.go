@@ -35,6 +35,15 @@ func TestInspectFormatDeps(t *testing.T) {
 			format: `{{if .x}}hit{{else}}miss{{end}}`,
 			deps:   formatDeps{capture: true},
 		},
+
+		{
+			format: `{{.Filename}}:{{.Line}}: {{.Author}} {{.Commit}} {{.AuthorDate}}`,
+			deps:   formatDeps{blame: true},
+		},
+		{
+			format: `{{.Author}}: {{.MatchLine}}`,
+			deps:   formatDeps{blame: true, matchLine: true},
+		},
 	}
 
 	for _, test := range tests {
@@ -45,6 +54,11 @@ func TestInspectFormatDeps(t *testing.T) {
 				test.format, have.capture, want.capture)
 			continue
 		}
+		if have.blame != want.blame {
+			t.Errorf("inspect `%s`: blame=%v (want %v)",
+				test.format, have.blame, want.blame)
+			continue
+		}
 		if have.matchLine != want.matchLine {
 			t.Errorf("inspect `%s`: matchLine=%v (want %v)",
 				test.format, have.matchLine, want.matchLine)
@@ -52,3 +66,28 @@ func TestInspectFormatDeps(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckCaptureNames(t *testing.T) {
+	tests := []struct {
+		pattern string
+		format  string
+		ok      bool
+	}{
+		{pattern: `f($Author)`, format: defaultFormat, ok: true},
+		{pattern: `f($x)`, format: `{{.Author}}: {{.x}}`, ok: true},
+		{pattern: `f($Commit)`, format: `{{.Author}}: {{.Commit}}`},
+		{pattern: `f(${"Author:var"})`, format: `{{.Author}}`},
+		{pattern: `f(${'Owners:expr'})`, format: `{{.Filename}} {{.Owners}}`},
+		{pattern: `f($AuthorDate)`, format: `{{.Author}}`, ok: true},
+	}
+
+	for _, test := range tests {
+		err := checkCaptureNames(test.pattern, inspectFormatDeps(test.format))
+		if test.ok && err != nil {
+			t.Errorf("check `%s` with `%s`: unexpected error: %v", test.pattern, test.format, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("check `%s` with `%s`: expected an error", test.pattern, test.format)
+		}
+	}
+}
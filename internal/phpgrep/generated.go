@@ -0,0 +1,68 @@
+package phpgrep
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// generatedHeaderSize is the number of leading bytes
+// that are checked for the generated file marker.
+const generatedHeaderSize = 2048
+
+const defaultGeneratedMarker = `@generated\b|Code generated .* DO NOT EDIT`
+
+// generatedDetector recognizes the generated and minified files,
+// they're skipped by the workers before parsing.
+type generatedDetector struct {
+	// marker is matched against the file header.
+	marker *regexp.Regexp
+
+	// maxLineLength is a minified files heuristic.
+	// Zero value disables the line lengths check.
+	maxLineLength int
+}
+
+func (p *program) compileGeneratedDetector() error {
+	if !p.args.skipGenerated {
+		return nil
+	}
+	if p.args.generatedLineLength < 0 {
+		return fmt.Errorf("generated-line-length can't be negative")
+	}
+	p.generated = &generatedDetector{maxLineLength: p.args.generatedLineLength}
+	if p.args.generatedMarker != "" {
+		var err error
+		p.generated.marker, err = regexp.Compile(p.args.generatedMarker)
+		if err != nil {
+			return fmt.Errorf("invalid generated-marker regexp: %v", err)
+		}
+	}
+	return nil
+}
+
+func (d *generatedDetector) isGenerated(data []byte) bool {
+	header := data
+	if len(header) > generatedHeaderSize {
+		header = header[:generatedHeaderSize]
+	}
+	if d.marker != nil && d.marker.Match(header) {
+		return true
+	}
+	if d.maxLineLength != 0 {
+		for len(data) != 0 {
+			end := bytes.IndexByte(data, '\n')
+			if end == -1 {
+				end = len(data)
+			}
+			if end > d.maxLineLength {
+				return true
+			}
+			data = data[end:]
+			if len(data) != 0 {
+				data = data[1:]
+			}
+		}
+	}
+	return false
+}
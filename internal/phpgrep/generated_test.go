@@ -0,0 +1,37 @@
+package phpgrep
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGeneratedDetector(t *testing.T) {
+	d := &generatedDetector{
+		marker:        regexp.MustCompile(defaultGeneratedMarker),
+		maxLineLength: 100,
+	}
+
+	tests := []struct {
+		data      string
+		generated bool
+	}{
+		{"<?php\nfunction f() {}\n", false},
+		{"<?php\n/** @generated */\nclass C {}\n", true},
+		{"<?php\n// Code generated by protoc-gen-php. DO NOT EDIT.\n", true},
+		{"<?php\n/** @generatedBy me */\n", false},
+		{"<?php\n" + strings.Repeat("x", 100) + "\n", false},
+		{"<?php\n" + strings.Repeat("x", 101) + "\n", true},
+		{"<?php\n" + strings.Repeat("x", 101), true},
+
+		// The marker is only searched in the file header.
+		{"<?php\n" + strings.Repeat("f();\n", 1000) + "// @generated\n", false},
+	}
+
+	for _, test := range tests {
+		have := d.isGenerated([]byte(test.data))
+		if have != test.generated {
+			t.Errorf("isGenerated(%.40q): have %v, want %v", test.data, have, test.generated)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package phpgrep
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFiles are loaded from every walked directory.
+// The latter ones have the higher priority.
+var ignoreFiles = []string{".gitignore", ".phpgrepignore"}
+
+// ignoreRule is a single ignore file line compiled into a regexp.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+
+	// anchored rules are matched against the path relative to
+	// the ignore file directory, others are matched against the name.
+	anchored bool
+}
+
+// ignoreLevel is a set of rules loaded from a single directory.
+type ignoreLevel struct {
+	rules []ignoreRule
+
+	// dir is the currently walked directory path
+	// relative to the rules directory; it's empty for the rules directory itself.
+	dir string
+}
+
+// ignoreMatcher implements the gitignore semantics for the walked directory.
+// A nil matcher doesn't ignore anything.
+type ignoreMatcher struct {
+	// levels are ordered from the outermost directory to the innermost one.
+	levels []ignoreLevel
+}
+
+// isIgnored reports whether the walked directory entry should be skipped.
+func (m *ignoreMatcher) isIgnored(name string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	// The deeper ignore files override the outer ones and
+	// the last matching rule inside a single file wins.
+	for i := len(m.levels) - 1; i >= 0; i-- {
+		level := &m.levels[i]
+		path := name
+		if level.dir != "" {
+			path = level.dir + "/" + name
+		}
+		for j := len(level.rules) - 1; j >= 0; j-- {
+			rule := &level.rules[j]
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			subject := name
+			if rule.anchored {
+				subject = path
+			}
+			if rule.re.MatchString(subject) {
+				return !rule.negate
+			}
+		}
+	}
+	return false
+}
+
+// child returns a matcher for the name subdirectory.
+func (m *ignoreMatcher) child(name string) *ignoreMatcher {
+	if m == nil {
+		return nil
+	}
+	levels := make([]ignoreLevel, len(m.levels))
+	for i, level := range m.levels {
+		levels[i] = level
+		if level.dir == "" {
+			levels[i].dir = name
+		} else {
+			levels[i].dir = level.dir + "/" + name
+		}
+	}
+	return &ignoreMatcher{levels: levels}
+}
+
+// withRules returns a matcher extended by the rules of the walked directory.
+func (m *ignoreMatcher) withRules(rules []ignoreRule) *ignoreMatcher {
+	if len(rules) == 0 {
+		return m
+	}
+	var levels []ignoreLevel
+	if m != nil {
+		levels = append(levels, m.levels...)
+	}
+	levels = append(levels, ignoreLevel{rules: rules})
+	return &ignoreMatcher{levels: levels}
+}
+
+// loadIgnoreRules extends the matcher with the ignore files of the dir.
+// has reports whether the dir contains an entry with the given name.
+//
+// A directory with .git inside starts a new repository,
+// so the outer ignore rules don't apply to it.
+func loadIgnoreRules(m *ignoreMatcher, dir string, has func(name string) bool) *ignoreMatcher {
+	var rules []ignoreRule
+	if has(".git") {
+		m = nil
+		// .git can be a file for the worktrees and submodules,
+		// the missing info/exclude is not an error.
+		data, err := ioutil.ReadFile(filepath.Join(dir, ".git", "info", "exclude"))
+		if err == nil {
+			rules = append(rules, parseIgnoreRules(data)...)
+		}
+	}
+	for _, name := range ignoreFiles {
+		if !has(name) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("error: read ignore file: %v", err)
+			}
+			continue
+		}
+		rules = append(rules, parseIgnoreRules(data)...)
+	}
+	return m.withRules(rules)
+}
+
+// targetIgnoreMatcher returns a matcher for the target directory.
+// It includes the ignore rules from the target parent directories
+// up to the repository root (a directory that contains .git).
+// If the target is not inside a repository, the parent rules are not used.
+func targetIgnoreMatcher(target string) (*ignoreMatcher, error) {
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	dir := absTarget
+	var parents []string
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			// Not inside a repository.
+			return nil, nil
+		}
+		dir = parent
+		parents = append(parents, dir)
+		if fileExists(filepath.Join(dir, ".git")) {
+			break
+		}
+	}
+
+	var m *ignoreMatcher
+	for i := len(parents) - 1; i >= 0; i-- {
+		dir := parents[i]
+		m = loadIgnoreRules(m, dir, func(name string) bool {
+			return fileExists(filepath.Join(dir, name))
+		})
+		if i == 0 {
+			m = m.child(filepath.Base(absTarget))
+		} else {
+			m = m.child(filepath.Base(parents[i-1]))
+		}
+	}
+	return m, nil
+}
+
+func isIgnoreFile(name string) bool {
+	for _, ignoreFile := range ignoreFiles {
+		if name == ignoreFile {
+			return true
+		}
+	}
+	return false
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+func parseIgnoreRules(data []byte) []ignoreRule {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		rule, ok := parseIgnoreRule(scanner.Text())
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	var rule ignoreRule
+
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored unless they're escaped.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+	// A separator at the beginning or in the middle makes the pattern
+	// relative to the ignore file directory.
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	re, err := regexp.Compile("^" + ignoreGlobToRegexp(line) + "$")
+	if err != nil {
+		// Like git, silently skip the malformed patterns.
+		return rule, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+// ignoreGlobToRegexp converts a gitignore glob into a regexp syntax.
+func ignoreGlobToRegexp(glob string) string {
+	var buf strings.Builder
+	for i := 0; i < len(glob); i++ {
+		ch := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			// Zero or more directories.
+			buf.WriteString("(?:.*/)?")
+			i += len("**/") - 1
+		case glob[i:] == "**" && i > 0 && glob[i-1] == '/':
+			// Everything inside.
+			buf.WriteString(".*")
+			i++
+		case ch == '*':
+			buf.WriteString("[^/]*")
+			for i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+			}
+		case ch == '?':
+			buf.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			fmt.Fprintf(&buf, "[%s]", strings.ReplaceAll(class, `\`, `\\`))
+			i += end + 1
+		case ch == '\\' && i+1 < len(glob):
+			i++
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,72 @@
+package phpgrep
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	root := (*ignoreMatcher)(nil).withRules(parseIgnoreRules([]byte(`
+# Comment line.
+/var/cache/
+node_modules
+*.generated.php
+!keep.generated.php
+build/**
+**/fixtures/*.php
+docs/*.php
+\#literal.php
+`)))
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{path: "var/cache", isDir: true, ignored: true},
+		{path: "var/cache", isDir: false, ignored: false},
+		{path: "src/var/cache", isDir: true, ignored: false},
+		{path: "node_modules", isDir: true, ignored: true},
+		{path: "src/node_modules", isDir: true, ignored: true},
+		{path: "a.generated.php", ignored: true},
+		{path: "src/b.generated.php", ignored: true},
+		{path: "src/keep.generated.php", ignored: false},
+		{path: "build", isDir: true, ignored: false},
+		{path: "build/a.php", ignored: true},
+		{path: "fixtures/a.php", ignored: true},
+		{path: "tests/unit/fixtures/a.php", ignored: true},
+		{path: "tests/unit/fixtures/a.inc", ignored: false},
+		{path: "docs/a.php", ignored: true},
+		{path: "src/docs/a.php", ignored: false},
+		{path: "#literal.php", ignored: true},
+		{path: "src/a.php", ignored: false},
+	}
+
+	for _, test := range tests {
+		m := root
+		parts := strings.Split(test.path, "/")
+		for _, dir := range parts[:len(parts)-1] {
+			m = m.child(dir)
+		}
+		name := parts[len(parts)-1]
+		have := m.isIgnored(name, test.isDir)
+		if have != test.ignored {
+			t.Errorf("isIgnored(%q, dir=%v): have %v, want %v", test.path, test.isDir, have, test.ignored)
+		}
+	}
+}
+
+func TestIgnoreMatcherNested(t *testing.T) {
+	m := (*ignoreMatcher)(nil).withRules(parseIgnoreRules([]byte("*.log.php\n/a.php\n")))
+	m = m.child("sub").withRules(parseIgnoreRules([]byte("!debug.log.php\n")))
+
+	if !m.isIgnored("x.log.php", false) {
+		t.Errorf("x.log.php should be ignored by the parent rules")
+	}
+	if m.isIgnored("debug.log.php", false) {
+		t.Errorf("debug.log.php should be re-included by the nested rules")
+	}
+	if m.isIgnored("a.php", false) {
+		t.Errorf("sub/a.php should not match the anchored /a.php rule")
+	}
+}
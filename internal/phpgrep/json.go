@@ -0,0 +1,146 @@
+package phpgrep
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// jsonReport is the --json output format.
+type jsonReport struct {
+	Matches []jsonMatch `json:"matches"`
+
+	// Found is the total number of matches found.
+	// It's greater than len(Matches) if the results were truncated.
+	Found     int64 `json:"found"`
+	Truncated bool  `json:"truncated"`
+
+	// StoppedEarly is set if the search was stopped after the --limit was reached,
+	// the Found is only a lower bound then.
+	StoppedEarly bool `json:"stopped_early,omitempty"`
+
+	// Skipped lists the files that were not grepped
+	// due to the --max-file-size or --file-timeout limits
+	// and the code sections that can't be parsed.
+	Skipped []jsonSkippedFile `json:"skipped,omitempty"`
+
+	// OwnerCounts is the --group-by owner summary.
+	// Matches of the files without owners are counted with an empty owner.
+	OwnerCounts []jsonOwnerCount `json:"owner_counts,omitempty"`
+
+	// Shards lists the --shard values that produced this report.
+	Shards []string `json:"shards,omitempty"`
+}
+
+type jsonMatch struct {
+	Filename  string            `json:"filename"`
+	Line      int               `json:"line"`
+	StartPos  int               `json:"start_pos"`
+	EndPos    int               `json:"end_pos"`
+	Match     string            `json:"match"`
+	MatchLine string            `json:"match_line"`
+	Captures  map[string]string `json:"captures,omitempty"`
+
+	// Blame fields are only set with --blame.
+	Author     string `json:"author,omitempty"`
+	Commit     string `json:"commit,omitempty"`
+	AuthorDate string `json:"author_date,omitempty"`
+
+	// Owners are only set if the CODEOWNERS file is used.
+	Owners []string `json:"owners,omitempty"`
+}
+
+type jsonOwnerCount struct {
+	Owner   string `json:"owner"`
+	Matches int    `json:"matches"`
+}
+
+type jsonSkippedFile struct {
+	Filename string `json:"filename"`
+	Reason   string `json:"reason"`
+}
+
+func (p *program) newJSONMatch(m match) (jsonMatch, error) {
+	filename := m.filename
+	if p.args.abs {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			return jsonMatch{}, fmt.Errorf("abs(%q): %v", m.filename, err)
+		}
+		filename = abs
+	}
+
+	result := jsonMatch{
+		Filename:  filename,
+		Line:      m.line,
+		StartPos:  m.startPos,
+		EndPos:    m.endPos,
+		Match:     m.matchText(),
+		MatchLine: m.text,
+	}
+	if m.blame != nil {
+		result.Author = m.blame.author
+		result.Commit = m.blame.commit
+		result.AuthorDate = m.blame.authorDate
+	}
+	result.Owners = m.owners
+	if len(m.captures) != 0 {
+		result.Captures = make(map[string]string, len(m.captures))
+		for _, c := range m.captures {
+			result.Captures[c.name] = m.captureText(c)
+		}
+	}
+	return result, nil
+}
+
+func (p *program) printJSONReport() error {
+	report := jsonReport{
+		Matches: []jsonMatch{},
+		Found:   p.matches + p.limit.dropped(),
+	}
+	if p.args.shard != "" {
+		report.Shards = []string{p.args.shard}
+	}
+
+	matches := p.collectMatches()
+	if uint(len(matches)) > p.args.limit {
+		matches = matches[:p.args.limit]
+	}
+	p.annotateMatches(matches, "")
+	for _, m := range matches {
+		if uint(len(report.Matches)) >= p.args.limit {
+			break
+		}
+		jm, err := p.newJSONMatch(m)
+		if err != nil {
+			return err
+		}
+		report.Matches = append(report.Matches, jm)
+	}
+	for _, f := range p.skipped.sorted() {
+		report.Skipped = append(report.Skipped, jsonSkippedFile{Filename: f.filename, Reason: f.reason})
+	}
+	if p.args.groupBy == "owner" {
+		for _, c := range p.owners.sortedCounts() {
+			owner := c.owner
+			if owner == unownedLabel {
+				owner = ""
+			}
+			report.OwnerCounts = append(report.OwnerCounts, jsonOwnerCount{Owner: owner, Matches: c.count})
+		}
+	}
+	report.StoppedEarly = p.stoppedEarly
+	report.Truncated = int64(len(report.Matches)) < report.Found ||
+		(p.limit != nil && p.limit.truncated())
+
+	return writeJSONReport(report)
+}
+
+func writeJSONReport(report jsonReport) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	// Matches are PHP code, so we don't want to escape <, > and &.
+	enc.SetEscapeHTML(false)
+	return enc.Encode(report)
+}
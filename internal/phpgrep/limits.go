@@ -0,0 +1,206 @@
+package phpgrep
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VKCOM/noverify/src/ir"
+	"github.com/VKCOM/noverify/src/php/parseutil"
+	"github.com/VKCOM/php-parser/pkg/ast"
+)
+
+var errFileTimeout = errors.New("file timeout exceeded")
+
+// skippedFile is a file that was not grepped due
+// to the --max-file-size or --file-timeout limits.
+// It can also be a code section that can't be parsed.
+type skippedFile struct {
+	filename string
+	reason   string
+}
+
+// skippedFiles is shared between the workers.
+type skippedFiles struct {
+	mu   sync.Mutex
+	list []skippedFile
+}
+
+func (s *skippedFiles) add(filename, reason string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.list = append(s.list, skippedFile{filename: filename, reason: reason})
+	s.mu.Unlock()
+}
+
+// sorted returns the skipped files ordered by filename.
+func (s *skippedFiles) sorted() []skippedFile {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]skippedFile, len(s.list))
+	copy(list, s.list)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].filename < list[j].filename
+	})
+	return list
+}
+
+// parseByteSize parses sizes like "1024", "512K", "20MB" or "1G".
+// The suffixes are powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+	scale := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		scale = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		scale = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		scale = 1 << 30
+	}
+	if scale != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size")
+	}
+	return n * scale, nil
+}
+
+// readFileLimited is like ioutil.ReadFile, but it doesn't read the files
+// that are larger than maxSize bytes. In this case, the data is nil.
+// A zero maxSize means that there is no limit.
+func readFileLimited(filename string, maxSize int64) (data []byte, size int64, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	if maxSize != 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+		if info.Size() > maxSize {
+			return nil, info.Size(), nil
+		}
+	}
+	data, err = ioutil.ReadAll(f)
+	return data, int64(len(data)), err
+}
+
+// skip adds the file to the skipped files report.
+// The skips are also remembered until the next file, so they can be checkpointed.
+func (w *worker) skip(filename, reason string) {
+	w.skipped.add(filename, reason)
+	w.fileSkips = append(w.fileSkips, skippedFile{filename: filename, reason: reason})
+}
+
+// checkFileSize reports whether the file is small enough to be grepped.
+func (w *worker) checkFileSize(filename string, size int64) bool {
+	if w.maxFileSize == 0 || size <= w.maxFileSize {
+		return true
+	}
+	w.stats.skippedSize++
+	w.skip(filename, fmt.Sprintf("file size %d exceeds --max-file-size", size))
+	return false
+}
+
+// newParseSlots returns the semaphore that bounds the number of
+// the running parsers: every worker can have one abandoned parser
+// besides the active one. After that, the workers wait for the
+// abandoned parsers to finish before parsing the next file.
+func newParseSlots(workers int) chan struct{} {
+	return make(chan struct{}, 2*workers)
+}
+
+// parseFileWithTimeout is like parseFile, but it gives up
+// if parsing takes longer than the worker deadline.
+//
+// The parser can't be interrupted, so it keeps running
+// in the background until it's done; only the result is discarded.
+// The number of such parsers is bounded by the parseSlots.
+func (w *worker) parseFileWithTimeout(data []byte) (*ir.Root, error) {
+	if w.deadline.IsZero() {
+		return w.parseFile(data)
+	}
+
+	if w.parseSlots != nil {
+		waitStart := time.Now()
+		w.parseSlots <- struct{}{}
+		// Waiting for the abandoned parsers is not a part of the file processing time.
+		w.deadline = w.deadline.Add(time.Since(waitStart))
+	}
+
+	type parseResult struct {
+		root *ast.Root
+		err  error
+	}
+	// Buffered, so the abandoned goroutine can exit.
+	resultCh := make(chan parseResult, 1)
+	go func() {
+		if w.parseSlots != nil {
+			defer func() { <-w.parseSlots }()
+		}
+		root, err := parseutil.ParseFile(data)
+		resultCh <- parseResult{root: root, err: err}
+	}()
+
+	timer := time.NewTimer(time.Until(w.deadline))
+	defer timer.Stop()
+	select {
+	case result := <-resultCh:
+		if result.err != nil {
+			return nil, result.err
+		}
+		// The converter is not thread-safe, so it's
+		// never used outside of the worker goroutine.
+		return w.irconv.ConvertRoot(result.root), nil
+	case <-timer.C:
+		return nil, errFileTimeout
+	}
+}
+
+// checkDeadline reports whether the file matching should be abandoned.
+// Checking the time for every node is too expensive,
+// so it's done only once per several nodes.
+func (w *worker) checkDeadline() bool {
+	if w.deadline.IsZero() {
+		return false
+	}
+	w.nodesVisited++
+	if w.nodesVisited%256 == 0 && time.Now().After(w.deadline) {
+		w.timedOut = true
+	}
+	return w.timedOut
+}
+
+func (w *worker) skipTimedOutFile(filename string) {
+	w.stats.timeouts++
+	w.skip(filename, fmt.Sprintf("processing takes longer than --file-timeout (%v)", w.fileTimeout))
+}
+
+func (p *program) printSkippedFiles() {
+	list := p.skipped.sorted()
+	if len(list) == 0 {
+		return
+	}
+	log.Printf("skipped %d files:", len(list))
+	for _, f := range list {
+		log.Printf("  %s: %s", f.filename, f.reason)
+	}
+}
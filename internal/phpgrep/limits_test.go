@@ -0,0 +1,67 @@
+package phpgrep
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VKCOM/noverify/src/ir/irconv"
+	"github.com/VKCOM/noverify/src/phpdoc"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		size int64
+		err  bool
+	}{
+		{s: "0", size: 0},
+		{s: "1024", size: 1024},
+		{s: "512K", size: 512 << 10},
+		{s: "512kb", size: 512 << 10},
+		{s: "20MB", size: 20 << 20},
+		{s: "1G", size: 1 << 30},
+		{s: "", err: true},
+		{s: "MB", err: true},
+		{s: "-1", err: true},
+		{s: "1.5MB", err: true},
+	}
+
+	for _, test := range tests {
+		size, err := parseByteSize(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseByteSize(%q): expected an error", test.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseByteSize(%q): unexpected error: %v", test.s, err)
+			continue
+		}
+		if size != test.size {
+			t.Errorf("parseByteSize(%q): have %d, want %d", test.s, size, test.size)
+		}
+	}
+}
+
+func TestParseSlotsReleased(t *testing.T) {
+	w := &worker{
+		irconv:     irconv.NewConverter(phpdoc.NewTypeParser()),
+		parseSlots: newParseSlots(1),
+	}
+	// More parses than slots: every finished parser should release its slot.
+	for i := 0; i < 5; i++ {
+		w.deadline = time.Now().Add(time.Minute)
+		if _, err := w.parseFileWithTimeout([]byte("<?php f();")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The slot is released after the result is sent.
+	for start := time.Now(); len(w.parseSlots) != 0; {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("%d parse slots are still held", len(w.parseSlots))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,263 @@
+package phpgrep
+
+import (
+	"bytes"
+	"strings"
+)
+
+// literalRequirement is satisfied if any of its alternatives
+// is present in the file contents.
+type literalRequirement [][]byte
+
+// literalFilter is used to skip the files that can't possibly
+// contain a match without parsing them.
+type literalFilter struct {
+	caseSensitive bool
+	requirements  []literalRequirement
+
+	// lowerBuf is reused to avoid allocations on every file.
+	lowerBuf []byte
+}
+
+func newLiteralFilter(pattern string, caseSensitive, fuzzy bool) *literalFilter {
+	words := requiredWords(pattern)
+	if len(words) == 0 {
+		return nil
+	}
+
+	f := &literalFilter{caseSensitive: caseSensitive}
+	seen := make(map[string]bool, len(words))
+	for _, w := range words {
+		if !caseSensitive {
+			w = strings.ToLower(w)
+		}
+		if seen[w] {
+			continue
+		}
+		seen[w] = true
+
+		alternatives := []string{w}
+		if fuzzy {
+			// Function aliases are normalized by the matcher,
+			// so doubleval() pattern matches floatval() calls.
+			if group, ok := funcAliasGroups[strings.ToLower(w)]; ok {
+				alternatives = append(alternatives, group...)
+			}
+		}
+		var req literalRequirement
+		for _, alt := range alternatives {
+			req = append(req, []byte(alt))
+		}
+		f.requirements = append(f.requirements, req)
+	}
+	return f
+}
+
+// mayMatch reports whether data contains all the required literals.
+// It can give false positives, but never false negatives.
+func (f *literalFilter) mayMatch(data []byte) bool {
+	if !f.caseSensitive {
+		// We care only about the ASCII case folding here:
+		// bytes.ToLower is much slower and allocates.
+		if cap(f.lowerBuf) < len(data) {
+			f.lowerBuf = make([]byte, len(data))
+		}
+		lower := f.lowerBuf[:len(data)]
+		for i, ch := range data {
+			if ch >= 'A' && ch <= 'Z' {
+				ch += 'a' - 'A'
+			}
+			lower[i] = ch
+		}
+		data = lower
+	}
+
+	for _, req := range f.requirements {
+		found := false
+		for _, alt := range req {
+			if bytes.Contains(data, alt) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// requiredWords returns the identifiers that must be present in
+// the source code text for the pattern to match.
+//
+// It's a conservative lexical approximation: everything that
+// can be normalized by the fuzzy matching (keywords, type names,
+// string and number literals) is never reported as required.
+func requiredWords(pattern string) []string {
+	// Heredoc bodies are hard to tell apart from the code.
+	if strings.Contains(pattern, "<<<") {
+		return nil
+	}
+
+	var words []string
+	s := pattern
+	for len(s) != 0 {
+		ch := s[0]
+		switch {
+		case ch == '$':
+			// Either a matcher variable $x or a matcher expression ${"x:var"}.
+			s = s[1:]
+			if strings.HasPrefix(s, "{") {
+				end := indexOutsideOfStrings(s, '}')
+				if end == -1 {
+					return words
+				}
+				s = s[end+1:]
+			} else {
+				s = skipIdent(s)
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			s = skipQuoted(s)
+		case ch == '#' || strings.HasPrefix(s, "//"):
+			end := strings.IndexByte(s, '\n')
+			if end == -1 {
+				return words
+			}
+			s = s[end:]
+		case strings.HasPrefix(s, "/*"):
+			end := strings.Index(s, "*/")
+			if end == -1 {
+				return words
+			}
+			s = s[end+len("*/"):]
+		case ch >= '0' && ch <= '9':
+			for len(s) != 0 && (isIdentChar(s[0]) || s[0] == '.') {
+				s = s[1:]
+			}
+		case isIdentChar(ch):
+			rest := skipIdent(s)
+			word := s[:len(s)-len(rest)]
+			s = rest
+			if !isKeywordLike(word) {
+				words = append(words, word)
+			}
+		default:
+			s = s[1:]
+		}
+	}
+	return words
+}
+
+func isIdentChar(ch byte) bool {
+	return isLetter(ch) || ch == '_' || (ch >= '0' && ch <= '9') || ch >= 0x80
+}
+
+func skipIdent(s string) string {
+	for len(s) != 0 && isIdentChar(s[0]) {
+		s = s[1:]
+	}
+	return s
+}
+
+func skipQuoted(s string) string {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			return s[i+1:]
+		}
+	}
+	return ""
+}
+
+func indexOutsideOfStrings(s string, ch byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'', '"':
+			rest := skipQuoted(s[i:])
+			i = len(s) - len(rest) - 1
+		case ch:
+			return i
+		}
+	}
+	return -1
+}
+
+func isKeywordLike(word string) bool {
+	word = strings.ToLower(word)
+	return strings.HasPrefix(word, "__") || phpKeywords[word]
+}
+
+// phpKeywords contains the reserved words and the type names.
+// The matcher can normalize them (like array() and [] or die and exit),
+// so they can't be required literally.
+var phpKeywords = map[string]bool{
+	"abstract": true, "and": true, "array": true, "as": true, "break": true,
+	"callable": true, "case": true, "catch": true, "class": true, "clone": true,
+	"const": true, "continue": true, "declare": true, "default": true, "die": true,
+	"do": true, "echo": true, "else": true, "elseif": true, "empty": true,
+	"enddeclare": true, "endfor": true, "endforeach": true, "endif": true, "endswitch": true,
+	"endwhile": true, "enum": true, "eval": true, "exit": true, "extends": true,
+	"final": true, "finally": true, "fn": true, "for": true, "foreach": true,
+	"function": true, "global": true, "goto": true, "if": true, "implements": true,
+	"include": true, "include_once": true, "instanceof": true, "insteadof": true, "interface": true,
+	"isset": true, "list": true, "match": true, "namespace": true, "new": true,
+	"or": true, "print": true, "private": true, "protected": true, "public": true,
+	"readonly": true, "require": true, "require_once": true, "return": true, "static": true,
+	"switch": true, "throw": true, "trait": true, "try": true, "unset": true,
+	"use": true, "var": true, "while": true, "xor": true, "yield": true,
+
+	"binary": true, "bool": true, "boolean": true, "double": true, "false": true,
+	"float": true, "int": true, "integer": true, "iterable": true, "mixed": true,
+	"never": true, "null": true, "object": true, "parent": true, "real": true,
+	"self": true, "string": true, "true": true, "void": true,
+}
+
+// funcAliasGroups maps every function from the PHP function aliases
+// list to all names that can be used to call that function.
+var funcAliasGroups = func() map[string][]string {
+	groups := [][]string{
+		{"rtrim", "chop"},
+		{"disk_free_space", "diskfreespace"},
+		{"floatval", "doubleval"},
+		{"fwrite", "fputs"},
+		{"gzwrite", "gzputs"},
+		{"ini_set", "ini_alter"},
+		{"is_float", "is_double", "is_real"},
+		{"is_int", "is_integer", "is_long"},
+		{"is_writable", "is_writeable"},
+		{"implode", "join"},
+		{"array_key_exists", "key_exists"},
+		{"current", "pos"},
+		{"highlight_file", "show_source"},
+		{"count", "sizeof"},
+		{"strstr", "strchr"},
+		{"checkdnsrr", "dns_check_record"},
+		{"getmxrr", "dns_get_mx"},
+		{"stream_set_write_buffer", "set_file_buffer"},
+		{"stream_get_meta_data", "socket_get_status"},
+		{"stream_set_blocking", "socket_set_blocking"},
+		{"stream_set_timeout", "socket_set_timeout"},
+		{"stream_wrapper_register", "stream_register_wrapper"},
+		{"trigger_error", "user_error"},
+		{"session_write_close", "session_commit"},
+		{"mysqli_real_escape_string", "mysqli_escape_string"},
+		{"mysqli_options", "mysqli_set_opt"},
+		{"openssl_pkey_get_private", "openssl_get_privatekey"},
+		{"openssl_pkey_get_public", "openssl_get_publickey"},
+		{"posix_get_last_error", "posix_errno"},
+		{"pcntl_get_last_error", "pcntl_errno"},
+		{"ldap_unbind", "ldap_close"},
+		{"odbc_exec", "odbc_do"},
+		{"odbc_field_len", "odbc_field_precision"},
+	}
+	m := make(map[string][]string)
+	for _, g := range groups {
+		for _, name := range g {
+			m[name] = g
+		}
+	}
+	return m
+}()
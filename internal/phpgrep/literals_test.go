@@ -0,0 +1,68 @@
+package phpgrep
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRequiredWords(t *testing.T) {
+	tests := []struct {
+		pattern string
+		words   []string
+	}{
+		{`$_`, nil},
+		{`$x = $y`, nil},
+		{`array_push($arr, $x)`, []string{"array_push"}},
+		{`$db->execute(${"*"})`, []string{"execute"}},
+		{`Foo::bar($x)`, []string{"Foo", "bar"}},
+		{`new \Foo\Bar()`, []string{"Foo", "Bar"}},
+		{`$x instanceof Foo`, []string{"Foo"}},
+		{`f(${"x:var"}, "str", 'foo', 0x1F, 1.5e10)`, []string{"f"}},
+		{`f(${"}"}, g())`, []string{"f", "g"}},
+		{`isset($x) ? $x : null`, nil},
+		{`array(1, 2)`, nil},
+		{`(int)$x`, nil},
+		{`__FILE__`, nil},
+		{`f() /* g() */ // h()`, []string{"f"}},
+		{`f(<<<EOT
+foo
+EOT
+)`, nil},
+	}
+
+	for _, test := range tests {
+		have := requiredWords(test.pattern)
+		if diff := cmp.Diff(test.words, have); diff != "" {
+			t.Errorf("requiredWords(`%s`) (+have -want):\n%s", test.pattern, diff)
+		}
+	}
+}
+
+func TestLiteralFilter(t *testing.T) {
+	tests := []struct {
+		pattern       string
+		caseSensitive bool
+		fuzzy         bool
+		data          string
+		mayMatch      bool
+	}{
+		{`array_push($_, $_)`, false, true, `<?php array_push($a, 1);`, true},
+		{`array_push($_, $_)`, false, true, `<?php ARRAY_PUSH($a, 1);`, true},
+		{`array_push($_, $_)`, true, true, `<?php ARRAY_PUSH($a, 1);`, false},
+		{`array_push($_, $_)`, false, true, `<?php $a[] = 1;`, false},
+		{`$_->execute()`, false, true, `<?php $q->Execute();`, true},
+		{`Foo::bar()`, false, true, `<?php Foo::baz();`, false},
+		{`doubleval($x)`, false, true, `<?php floatval($x);`, true},
+		{`doubleval($x)`, false, false, `<?php floatval($x);`, false},
+	}
+
+	for _, test := range tests {
+		f := newLiteralFilter(test.pattern, test.caseSensitive, test.fuzzy)
+		have := f.mayMatch([]byte(test.data))
+		if have != test.mayMatch {
+			t.Errorf("filter `%s` on `%s`: have %v, want %v",
+				test.pattern, test.data, have, test.mayMatch)
+		}
+	}
+}
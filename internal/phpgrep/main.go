@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"time"
 )
 
 const (
@@ -16,6 +17,8 @@ const (
 
 const defaultFormat = `{{.Filename}}:{{.Line}}: {{.MatchLine}}`
 
+const defaultPHPFileExt = "php,php5,inc,phtml"
+
 type arguments struct {
 	replace       bool
 	verbose       bool
@@ -24,23 +27,61 @@ type arguments struct {
 	caseSensitive bool
 	noColor       bool
 	strictSyntax  bool
+	watch         bool
+	tui           bool
+	stats         bool
+	json          bool
+	noIgnore      bool
+	sniffPHP      bool
+	markdown      bool
+	blame         bool
 
 	limit uint
 
+	// limitSet is true if --limit is passed explicitly.
+	limitSet bool
+
 	cpuProfile string
 	memProfile string
 
+	cacheDir string
+
+	skipGenerated       bool
+	generatedMarker     string
+	generatedLineLength int
+
+	maxFileSize string
+	fileTimeout time.Duration
+
+	checkpoint         string
+	checkpointInterval time.Duration
+
+	statsFormat string
+
 	phpFileExt     string
 	phpFileExtList []string
 
 	targets        string
+	filesFrom      string
+	stdinFilename  string
+	diffBase       string
+	diffFile       string
+	compareRev     string
+	codeowners     string
+	groupBy        string
 	pattern        string
 	filters        []string
-	exclude        string
+	excludes       stringList
+	includes       stringList
 	format         string
 	excludeResults string
 
 	progressMode string
+	shard        string
+	sort         string
+
+	watchPrint    string
+	watchInterval time.Duration
 
 	filenameColor string
 	lineColor     string
@@ -52,6 +93,15 @@ type arguments struct {
 func Main() (int, error) {
 	log.SetFlags(0)
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "repl":
+			return replMain(os.Args[2:])
+		case "merge":
+			return mergeMain(os.Args[2:])
+		}
+	}
+
 	var args arguments
 	parseFlags(&args)
 
@@ -63,15 +113,24 @@ func Main() (int, error) {
 		name string
 		fn   func() error
 	}{
+		{"validate pattern", p.validatePattern},
 		{"validate flags", p.validateFlags},
 		{"start profiling", p.startProfiling},
 		{"compile filters", p.compileFilters},
 		{"compile exclude results", p.compileExcludeResults},
-		{"compile exclude pattern", p.compileExcludePattern},
+		{"compile path filters", p.compilePathFilters},
+		{"load diff", p.loadDiff},
+		{"compile generated detector", p.compileGeneratedDetector},
 		{"compile pattern", p.compilePattern},
 		{"compile output format", p.compileOutputFormat},
+		{"load codeowners", p.loadCodeowners},
+		{"load checkpoint", p.loadCheckpoint},
 		{"execute pattern", p.executePattern},
+		{"compare revision", p.compareRevision},
 		{"print matches", p.printMatches},
+		{"print stats", p.printStats},
+		{"watch targets", p.watchTargets},
+		{"browse matches", p.browseMatches},
 		{"replace matches", p.replaceMatches},
 		{"finish profiling", p.finishProfiling},
 	}
@@ -94,9 +153,13 @@ func Main() (int, error) {
 func parseFlags(args *arguments) {
 	flag.Usage = func() {
 		const usage = `Usage: phpgrep [flags...] targets pattern [filters...]
+       phpgrep --files-from list [flags...] pattern [filters...]
+       phpgrep repl [flags...] targets
+       phpgrep merge report.json...
 Where:
   flags are command-line arguments that are listed in -help (see below)
-  targets is a comma-separated list of file or directory names to search in
+  targets is a comma-separated list of file or directory names to search in,
+    "-" reads the code from stdin; zip, tar(.gz) and phar archives are searched too
   pattern is a string that describes what is being matched
   filters are optional arguments bound to the pattern
 
@@ -122,12 +185,51 @@ Examples:
   # Ignore vendored source code inside project.
   phpgrep --exclude '/vendor/' project/ 'pattern'
 
+  # Keep printing the match set changes while the files are being edited.
+  phpgrep --watch project/ 'pattern'
+
+  # Triage the results interactively.
+  phpgrep --tui --exclude-results baseline.txt project/ 'pattern'
+
+  # Split the search between 2 CI jobs and combine their results.
+  phpgrep --json --shard 1/2 project/ 'pattern' > shard1.json
+  phpgrep --json --shard 2/2 project/ 'pattern' > shard2.json
+  phpgrep merge shard1.json shard2.json
+
+  # Search inside the vendored phar bundle.
+  phpgrep vendor.phar 'pattern'
+
+  # Search the PHP code blocks of the documentation.
+  phpgrep --markdown docs/ 'pattern'
+
+  # Search the code from the previous commit.
+  git show HEAD~1:src/a.php | phpgrep --stdin-filename src/a.php - 'pattern'
+
+  # Report only the matches that touch the lines added since the main branch.
+  phpgrep --diff-base main . 'pattern'
+
+  # Check whether the working tree adds or removes the matches compared to the main branch.
+  phpgrep --compare-rev main . 'pattern'
+
+  # Count the matches per CODEOWNERS owner.
+  phpgrep --group-by owner . 'pattern'
+
+  # Search only the files changed since the main branch.
+  git diff --name-only -z main | phpgrep --files-from - 'pattern'
+
+  # Parse the project once and try different patterns interactively.
+  phpgrep repl project/
+
 Custom output formatting is possible via the -format flag template.
-  {{.Filename}}  match containing file name
-  {{.Line}}      line number where the match started
-  {{.MatchLine}} a source code line that contains the match
-  {{.Match}}     an entire match string
-  {{.x}}         $x submatch string (can be any submatch name)
+  {{.Filename}}   match containing file name
+  {{.Line}}       line number where the match started
+  {{.MatchLine}}  a source code line that contains the match
+  {{.Match}}      an entire match string
+  {{.x}}          $x submatch string (can be any submatch name)
+  {{.Author}}     the author of the last commit that touched the match (git blame)
+  {{.Commit}}     the last commit that touched the match (git blame)
+  {{.AuthorDate}} the author date of the last commit that touched the match (git blame)
+  {{.Owners}}     space-separated match file owners from the CODEOWNERS file
 
 The output colors can be configured with "--color-<name>" flags.
 Use --no-color to disable the output coloring.
@@ -145,69 +247,138 @@ Supported command-line flags:
 		flag.PrintDefaults()
 	}
 
-	flag.BoolVar(&args.replace, "i", false,
+	bindFlags(flag.CommandLine, args)
+	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "limit" {
+			args.limitSet = true
+		}
+	})
+
+	argv := flag.Args()
+	// With --files-from, there is no targets argument.
+	if args.filesFrom == "" && len(argv) != 0 {
+		args.targets = argv[0]
+		argv = argv[1:]
+	}
+	if len(argv) != 0 {
+		args.pattern = argv[0]
+	}
+	if len(argv) > 1 {
+		args.filters = argv[1:]
+	}
+	if args.verbose {
+		args.progressMode = "append"
+	}
+
+	if args.verbose {
+		log.Printf("debug: targets: %s", args.targets)
+		log.Printf("debug: pattern: %s", args.pattern)
+		log.Printf("debug: filters: %#v", args.filters)
+	}
+}
+
+func bindFlags(fs *flag.FlagSet, args *arguments) {
+	fs.BoolVar(&args.replace, "i", false,
 		`replace matches with --format result in-place`)
-	flag.BoolVar(&args.verbose, "v", false,
+	fs.BoolVar(&args.verbose, "v", false,
 		`verbose mode: turn on additional debug logging`)
-	flag.BoolVar(&args.multiline, "m", false,
+	fs.BoolVar(&args.multiline, "m", false,
 		`multiline mode: print matches without escaping newlines to \n`)
-	flag.BoolVar(&args.caseSensitive, "case-sensitive", false,
+	fs.BoolVar(&args.caseSensitive, "case-sensitive", false,
 		`do a strict case matching, so F() and f() are considered to be distinct`)
-	flag.BoolVar(&args.strictSyntax, "strict-syntax", false,
+	fs.BoolVar(&args.strictSyntax, "strict-syntax", false,
 		`disable syntax normalizations, so 'array()' and '[]' are not considered to be identical, and so on`)
-	flag.BoolVar(&args.noColor, "no-color", false,
+	fs.BoolVar(&args.noColor, "no-color", false,
 		`disable the colored output`)
-	flag.BoolVar(&args.abs, "abs", false,
+	fs.BoolVar(&args.abs, "abs", false,
 		`print absolute filenames in the output`)
-	flag.UintVar(&args.limit, "limit", 1000,
+	fs.UintVar(&args.limit, "limit", 1000,
 		`stop after this many match results, 0 for unlimited`)
-	flag.IntVar(&args.workers, "workers", runtime.NumCPU(),
+	fs.IntVar(&args.workers, "workers", runtime.NumCPU(),
 		`set the number of concurrent workers`)
-	flag.StringVar(&args.memProfile, "memprofile", "",
+	fs.BoolVar(&args.stats, "stats", false,
+		`print the search statistics to the stderr at the end of a run`)
+	fs.StringVar(&args.statsFormat, "stats-format", "text",
+		`--stats output format: "text" or "json"`)
+	fs.StringVar(&args.memProfile, "memprofile", "",
 		`write memory profile to the specified file`)
-	flag.StringVar(&args.cpuProfile, "cpuprofile", "",
+	fs.StringVar(&args.cpuProfile, "cpuprofile", "",
 		`write CPU profile to the specified file`)
-	flag.StringVar(&args.exclude, "exclude", "",
-		`exclude files or directories by regexp pattern`)
-	flag.StringVar(&args.excludeResults, "exclude-results", "",
+	fs.Var(&args.excludes, "exclude",
+		`exclude files or directories by glob or regexp pattern, can be repeated`)
+	fs.StringVar(&args.filesFrom, "files-from", "",
+		`read a newline or NUL-separated list of files to search from the file ("-" for stdin) instead of walking the targets`)
+	fs.StringVar(&args.stdinFilename, "stdin-filename", "<stdin>",
+		`the {{.Filename}} value for the code that is read from the "-" target`)
+	fs.StringVar(&args.diffBase, "diff-base", "",
+		`report only the matches that touch the lines added since the specified git revision`)
+	fs.StringVar(&args.diffFile, "diff-file", "",
+		`report only the matches that touch the lines added by the unified diff file ("-" for stdin)`)
+	fs.StringVar(&args.compareRev, "compare-rev", "",
+		`compare the results with the same search at the specified git revision and print the added and removed matches`)
+	fs.Var(&args.includes, "include",
+		`only search files that match the glob or regexp pattern, can be repeated`)
+	fs.BoolVar(&args.noIgnore, "no-ignore", false,
+		`don't respect .gitignore, .git/info/exclude and .phpgrepignore files`)
+	fs.StringVar(&args.cacheDir, "cache-dir", "",
+		`store the per-file match results in the specified dir to skip unchanged files next time`)
+	fs.BoolVar(&args.skipGenerated, "skip-generated", false,
+		`skip the files that look generated or minified`)
+	fs.StringVar(&args.generatedMarker, "generated-marker", defaultGeneratedMarker,
+		`a regexp that marks a generated file if it matches inside the file header; used with --skip-generated`)
+	fs.IntVar(&args.generatedLineLength, "generated-line-length", 5000,
+		`consider files with lines longer than this many bytes minified, 0 to disable; used with --skip-generated`)
+	fs.StringVar(&args.maxFileSize, "max-file-size", "",
+		`skip files larger than the specified size (like 512K or 20MB)`)
+	fs.DurationVar(&args.fileTimeout, "file-timeout", 0,
+		`abandon files that take longer than the specified duration to parse and match`)
+	fs.StringVar(&args.checkpoint, "checkpoint", "",
+		`periodically save the search progress to the specified file and resume from it after a restart`)
+	fs.DurationVar(&args.checkpointInterval, "checkpoint-interval", 30*time.Second,
+		`how often to save the --checkpoint file`)
+	fs.StringVar(&args.excludeResults, "exclude-results", "",
 		`exclude the results listed in the file`)
-	flag.StringVar(&args.phpFileExt, "php-ext", "php,php5,inc,phtml",
+	fs.StringVar(&args.phpFileExt, "php-ext", defaultPHPFileExt,
 		`a comma-separated list of extensions to scan`)
-
-	flag.StringVar(&args.progressMode, "progress", "update",
+	fs.BoolVar(&args.sniffPHP, "sniff-php", false,
+		`also scan the files without extension that start with "<?php" or a php shebang line`)
+	fs.BoolVar(&args.markdown, "markdown", false,
+		"also scan the ```php code blocks inside the .md files")
+
+	fs.BoolVar(&args.json, "json", false,
+		`print the results as a JSON report instead of using the --format`)
+	fs.BoolVar(&args.blame, "blame", false,
+		`add the git blame info to the --json report matches; it's enabled automatically if the --format uses the blame fields`)
+	fs.StringVar(&args.codeowners, "codeowners", "",
+		`read the {{.Owners}} from the specified CODEOWNERS file instead of the one found in the repository`)
+	fs.StringVar(&args.groupBy, "group-by", "",
+		`print the number of matches per group instead of the matches; only "owner" is supported`)
+	fs.StringVar(&args.shard, "shard", "",
+		`scan only the K-th of N disjoint file subsets, in K/N form (like 2/4)`)
+	fs.StringVar(&args.sort, "sort", "path",
+		`results ordering: "path" (by filename, then by offset) or "none" (unspecified order)`)
+	fs.StringVar(&args.progressMode, "progress", "update",
 		`progress printing mode: "update", "append" or "none"`)
 
-	flag.StringVar(&args.filenameColor, "color-filename", envVarOrDefault("PHPGREP_COLOR_FILENAME", "dark-magenta"),
+	fs.BoolVar(&args.watch, "watch", false,
+		`after the search is done, re-grep the modified files and print the updated results`)
+	fs.BoolVar(&args.tui, "tui", false,
+		`browse the results in the full-screen terminal UI`)
+	fs.StringVar(&args.watchPrint, "watch-print", "delta",
+		`watch mode results printing: "delta" or "all"`)
+	fs.DurationVar(&args.watchInterval, "watch-interval", time.Second,
+		`how often to check the targets for changes in watch mode`)
+
+	fs.StringVar(&args.filenameColor, "color-filename", envVarOrDefault("PHPGREP_COLOR_FILENAME", "dark-magenta"),
 		`{{.Filename}} text color`)
-	flag.StringVar(&args.lineColor, "color-line", envVarOrDefault("PHPGREP_COLOR_LINE", "dark-green"),
+	fs.StringVar(&args.lineColor, "color-line", envVarOrDefault("PHPGREP_COLOR_LINE", "dark-green"),
 		`{{.Line}} text color`)
-	flag.StringVar(&args.matchColor, "color-match", envVarOrDefault("PHPGREP_COLOR_MATCH", "dark-red"),
+	fs.StringVar(&args.matchColor, "color-match", envVarOrDefault("PHPGREP_COLOR_MATCH", "dark-red"),
 		`{{.Match}} text color`)
 
-	flag.StringVar(&args.format, "format", defaultFormat,
+	fs.StringVar(&args.format, "format", defaultFormat,
 		`specify an alternate format for the output, using the syntax Go templates`)
-
-	flag.Parse()
-
-	argv := flag.Args()
-	if len(argv) != 0 {
-		args.targets = argv[0]
-	}
-	if len(argv) >= 2 {
-		args.pattern = argv[1]
-	}
-	if len(argv) > 2 {
-		args.filters = argv[2:]
-	}
-	if args.verbose {
-		args.progressMode = "append"
-	}
-
-	if args.verbose {
-		log.Printf("debug: targets: %s", args.targets)
-		log.Printf("debug: pattern: %s", args.pattern)
-		log.Printf("debug: filters: %#v", args.filters)
-	}
 }
 
 func envVarOrDefault(envKey, defaultValue string) string {
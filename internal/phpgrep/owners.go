@@ -0,0 +1,386 @@
+package phpgrep
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// codeownersLocations are checked inside the repository root
+// if the --codeowners file is not specified.
+var codeownersLocations = []string{
+	".github/CODEOWNERS",
+	"CODEOWNERS",
+	"docs/CODEOWNERS",
+	".gitlab/CODEOWNERS",
+}
+
+// unownedLabel is used in the --group-by owner summary for the files without owners.
+const unownedLabel = "(unowned)"
+
+// codeowners resolves the file owners using the CODEOWNERS rules.
+type codeowners struct {
+	// root is the directory the rule paths are relative to.
+	root string
+
+	sections []codeownersSection
+
+	mu    sync.Mutex
+	cache map[string][]string
+
+	// counts are collected for the --group-by owner summary.
+	counts map[string]int
+}
+
+// codeownersSection is a GitLab [Section]; the rules before
+// the first section header belong to the unnamed section.
+// The last matching rule of every section contributes to the owners.
+type codeownersSection struct {
+	name          string
+	defaultOwners []string
+	rules         []codeownersRule
+}
+
+type codeownersRule struct {
+	ignoreRule
+
+	// filesOnly is set for the "dir/*" patterns
+	// that don't match the nested directories contents.
+	filesOnly bool
+
+	// owners is empty if the rule removes the owners.
+	owners []string
+}
+
+func (p *program) loadCodeowners() error {
+	deps := inspectFormatDeps(p.args.format)
+	if p.args.codeowners == "" && !deps.owners && p.args.groupBy == "" {
+		return nil
+	}
+
+	filename := p.args.codeowners
+	if filename == "" {
+		found, err := findCodeowners()
+		if err != nil {
+			return err
+		}
+		filename = found
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+
+	// The paths are relative to the repository root, but an arbitrary
+	// CODEOWNERS file outside of a repository is relative to its own directory.
+	root := filepath.Dir(absFilename)
+	if repoRoot := findRepositoryRoot(root); repoRoot != "" {
+		root = repoRoot
+	}
+	p.owners = &codeowners{
+		root:     root,
+		sections: parseCodeowners(data),
+		cache:    make(map[string][]string),
+	}
+	if p.args.groupBy == "owner" {
+		p.owners.counts = make(map[string]int)
+	}
+	if p.args.verbose {
+		log.Printf("debug: using %s, paths are relative to %s", filename, root)
+	}
+	return nil
+}
+
+// findCodeowners returns the CODEOWNERS file of the current directory repository.
+func findCodeowners() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	root := findRepositoryRoot(wd)
+	if root == "" {
+		return "", fmt.Errorf("not inside a git repository, use --codeowners to specify the file")
+	}
+	for _, location := range codeownersLocations {
+		filename := filepath.Join(root, filepath.FromSlash(location))
+		if fileExists(filename) {
+			return filename, nil
+		}
+	}
+	return "", fmt.Errorf("no CODEOWNERS file found in %s, use --codeowners to specify the file", root)
+}
+
+// findRepositoryRoot returns the closest dir parent (or the dir itself) that contains .git.
+// It returns an empty string if the dir is not inside a repository.
+func findRepositoryRoot(dir string) string {
+	for {
+		if fileExists(filepath.Join(dir, ".git")) {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// fileOwners returns the owners of the file.
+// The result is empty (but not nil) if the file has no owners.
+func (c *codeowners) fileOwners(filename string) []string {
+	c.mu.Lock()
+	owners, ok := c.cache[filename]
+	c.mu.Unlock()
+	if ok {
+		return owners
+	}
+
+	owners = []string{}
+	// Archive entries are owned by the archive owners.
+	archive, _, _ := splitArchiveEntry(filename)
+	if path, ok := c.relativePath(archive); ok {
+		owners = c.resolve(path)
+	}
+	c.mu.Lock()
+	c.cache[filename] = owners
+	c.mu.Unlock()
+	return owners
+}
+
+func (c *codeowners) relativePath(filename string) (string, bool) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(c.root, abs)
+	if err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+// resolve returns the owners for the slash-separated path relative to the root.
+func (c *codeowners) resolve(path string) []string {
+	owners := []string{}
+	seen := make(map[string]bool)
+	for i := range c.sections {
+		section := &c.sections[i]
+		for j := len(section.rules) - 1; j >= 0; j-- {
+			rule := &section.rules[j]
+			if !rule.matches(path) {
+				continue
+			}
+			for _, owner := range rule.owners {
+				if !seen[owner] {
+					seen[owner] = true
+					owners = append(owners, owner)
+				}
+			}
+			break
+		}
+	}
+	return owners
+}
+
+// matches reports whether the rule matches the file
+// or any of the directories it's located in.
+func (r *codeownersRule) matches(path string) bool {
+	segments := strings.Split(path, "/")
+	for i := range segments {
+		isDir := i != len(segments)-1
+		if (isDir && r.filesOnly) || (!isDir && r.dirOnly) {
+			continue
+		}
+		subject := segments[i]
+		if r.anchored {
+			subject = strings.Join(segments[:i+1], "/")
+		}
+		if r.re.MatchString(subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// countMatches adds n filename matches to the --group-by owner summary.
+func (c *codeowners) countMatches(filename string, n int) {
+	if c == nil || c.counts == nil || n == 0 {
+		return
+	}
+	owners := c.fileOwners(filename)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(owners) == 0 {
+		c.counts[unownedLabel] += n
+	}
+	for _, owner := range owners {
+		c.counts[owner] += n
+	}
+}
+
+type ownerCount struct {
+	owner string
+	count int
+}
+
+// sortedCounts returns the summary ordered by the number of matches.
+func (c *codeowners) sortedCounts() []ownerCount {
+	counts := make([]ownerCount, 0, len(c.counts))
+	for owner, count := range c.counts {
+		counts = append(counts, ownerCount{owner: owner, count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return counts[i].owner < counts[j].owner
+	})
+	return counts
+}
+
+// annotateOwners sets the owners for the matches.
+func (p *program) annotateOwners(matches []match) {
+	if p.owners == nil {
+		return
+	}
+	for i := range matches {
+		matches[i].owners = p.owners.fileOwners(matches[i].filename)
+	}
+}
+
+// printOwnerCounts prints the --group-by owner summary instead of the matches.
+func (p *program) printOwnerCounts() {
+	counts := p.owners.sortedCounts()
+	width := 0
+	for _, c := range counts {
+		if w := len(fmt.Sprint(c.count)); w > width {
+			width = w
+		}
+	}
+	for _, c := range counts {
+		fmt.Printf("%*d %s\n", width, c.count, c.owner)
+	}
+	if p.limit != nil && p.limit.truncated() {
+		log.Printf("the search was stopped at %d matches, the counts are incomplete", p.args.limit)
+	}
+	log.Printf("found %d matches in %d owner groups", p.matches, len(counts))
+}
+
+// parseCodeowners parses the GitHub or GitLab CODEOWNERS file.
+func parseCodeowners(data []byte) []codeownersSection {
+	sections := []codeownersSection{{}}
+	sectionIndex := map[string]int{"": 0}
+	current := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if name, owners, ok := parseCodeownersSection(line); ok {
+			// GitLab merges the sections with the same name.
+			key := strings.ToLower(name)
+			i, ok := sectionIndex[key]
+			if !ok {
+				i = len(sections)
+				sectionIndex[key] = i
+				sections = append(sections, codeownersSection{name: name})
+			}
+			if len(owners) != 0 {
+				sections[i].defaultOwners = owners
+			}
+			current = i
+			continue
+		}
+
+		pattern, owners := splitCodeownersLine(line)
+		rule, ok := parseCodeownersRule(pattern)
+		if !ok {
+			continue
+		}
+		rule.owners = owners
+		if len(owners) == 0 {
+			rule.owners = sections[current].defaultOwners
+		}
+		sections[current].rules = append(sections[current].rules, rule)
+	}
+	return sections
+}
+
+// parseCodeownersSection parses the GitLab "[Section][approvals] @owners" line.
+// Optional sections start with "^".
+func parseCodeownersSection(line string) (name string, owners []string, ok bool) {
+	line = strings.TrimPrefix(line, "^")
+	if !strings.HasPrefix(line, "[") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(line, ']')
+	if end == -1 {
+		return "", nil, false
+	}
+	name = line[1:end]
+	rest := line[end+1:]
+	if strings.HasPrefix(rest, "[") {
+		if approvalsEnd := strings.IndexByte(rest, ']'); approvalsEnd != -1 {
+			rest = rest[approvalsEnd+1:]
+		}
+	}
+	_, owners = splitCodeownersLine("_ " + rest)
+	return name, owners, true
+}
+
+// splitCodeownersLine splits the line into the path pattern and the owners.
+// Spaces inside the pattern can be escaped with a backslash.
+func splitCodeownersLine(line string) (pattern string, owners []string) {
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == ' ' || line[i] == '\t' {
+			end = i
+			break
+		}
+	}
+	pattern = line[:end]
+	for _, field := range strings.Fields(line[end:]) {
+		if strings.HasPrefix(field, "#") {
+			break
+		}
+		owners = append(owners, field)
+	}
+	return pattern, owners
+}
+
+func parseCodeownersRule(pattern string) (codeownersRule, bool) {
+	// Negation is not supported by the CODEOWNERS files.
+	if strings.HasPrefix(pattern, "!") {
+		return codeownersRule{}, false
+	}
+	rule, ok := parseIgnoreRule(pattern)
+	if !ok {
+		return codeownersRule{}, false
+	}
+	return codeownersRule{
+		ignoreRule: rule,
+		filesOnly:  strings.HasSuffix(pattern, "/*"),
+	}, true
+}
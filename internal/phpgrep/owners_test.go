@@ -0,0 +1,59 @@
+package phpgrep
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCodeownersResolve(t *testing.T) {
+	data := `
+# Default owners.
+*       @global-owner
+
+*.js    @js-owner # inline comment
+/build/logs/ @doctocat
+docs/*  docs@example.com
+apps/   @octocat
+/scripts/ @doctocat @octocat
+/apps/github
+my\ dir/ @spaces
+
+[Database][2] @dba
+*.sql
+/db/legacy/ @legacy-dba
+^[Optional]
+/src/Payments/ @payments
+`
+	owners := &codeowners{
+		sections: parseCodeowners([]byte(data)),
+		cache:    make(map[string][]string),
+	}
+
+	tests := []struct {
+		path   string
+		owners string
+	}{
+		{"index.php", "@global-owner"},
+		{"web/app.js", "@js-owner"},
+		{"build/logs/a.log", "@doctocat"},
+		{"build/logs/nested/a.log", "@doctocat"},
+		{"src/build/logs/a.log", "@global-owner"},
+		{"docs/intro.md", "docs@example.com"},
+		{"docs/build-app/troubleshooting.md", "@global-owner"},
+		{"src/docs/intro.md", "@global-owner"},
+		{"lib/apps/a.php", "@octocat"},
+		{"scripts/deploy.php", "@doctocat @octocat"},
+		{"apps/github/a.php", ""},
+		{"apps/other/a.php", "@octocat"},
+		{"my dir/a.php", "@spaces"},
+		{"schema.sql", "@global-owner @dba"},
+		{"db/legacy/a.sql", "@global-owner @legacy-dba"},
+		{"src/Payments/Gateway.php", "@global-owner @payments"},
+	}
+	for _, test := range tests {
+		have := strings.Join(owners.resolve(test.path), " ")
+		if have != test.owners {
+			t.Errorf("%s: have %q, want %q", test.path, have, test.owners)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package phpgrep
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// pathFilter is a compiled --include or --exclude pattern.
+type pathFilter struct {
+	re *regexp.Regexp
+
+	// absolute filters are matched against the absolute path,
+	// others are matched against the path relative to the target root.
+	absolute bool
+
+	// isRegexp filters are matched against the whole relative path.
+	isRegexp bool
+
+	// These are only used for the globs, see ignoreRule.
+	anchored bool
+	dirOnly  bool
+}
+
+// stringList is a repeatable flag value.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// compilePathFilter parses a path filter pattern.
+//
+// Patterns with "glob:" and "re:" prefixes are globs and regexps that are
+// matched against the path relative to the target root.
+// Unprefixed patterns are globs too, except for the --exclude patterns
+// that are valid regexps without "**": they're matched against
+// the absolute path, this is how the --exclude always worked.
+func compilePathFilter(pattern string, exclude bool) (*pathFilter, error) {
+	switch {
+	case strings.HasPrefix(pattern, "glob:"):
+		return compileGlobFilter(strings.TrimPrefix(pattern, "glob:"))
+	case strings.HasPrefix(pattern, "re:"):
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return nil, err
+		}
+		return &pathFilter{re: re, isRegexp: true}, nil
+	case exclude && !strings.Contains(pattern, "**"):
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			// Like "*.php", it can only be a glob.
+			return compileGlobFilter(pattern)
+		}
+		return &pathFilter{re: re, absolute: true}, nil
+	default:
+		return compileGlobFilter(pattern)
+	}
+}
+
+// compileGlobFilter compiles a glob with the gitignore semantics:
+// a pattern without slashes in the beginning or in the middle
+// matches the file name at any level, a trailing slash makes it
+// match only directories and "**" matches any number of directories.
+func compileGlobFilter(glob string) (*pathFilter, error) {
+	f := &pathFilter{}
+	if strings.HasSuffix(glob, "/") {
+		f.dirOnly = true
+		glob = strings.TrimRight(glob, "/")
+	}
+	if glob == "" {
+		return nil, fmt.Errorf("empty glob")
+	}
+	if strings.Contains(glob, "/") {
+		f.anchored = true
+		glob = strings.TrimPrefix(glob, "/")
+	}
+	re, err := regexp.Compile("^" + ignoreGlobToRegexp(glob) + "$")
+	if err != nil {
+		return nil, err
+	}
+	f.re = re
+	return f, nil
+}
+
+// walkedPath describes a walked file or directory for the path filters.
+type walkedPath struct {
+	path  string
+	rel   string // Slash-separated path relative to the target root
+	isDir bool
+
+	abs string // Lazily computed absolute path
+}
+
+func (p *walkedPath) absPath() string {
+	if p.abs == "" {
+		abs, err := filepath.Abs(p.path)
+		if err != nil {
+			log.Printf("error: abs(%s): %v", p.path, err)
+			abs = p.path
+		}
+		p.abs = abs
+	}
+	return p.abs
+}
+
+func (f *pathFilter) match(p *walkedPath) bool {
+	switch {
+	case f.absolute:
+		return f.re.MatchString(p.absPath())
+	case p.rel == "" || (f.dirOnly && !p.isDir):
+		return false
+	case f.isRegexp || f.anchored:
+		return f.re.MatchString(p.rel)
+	default:
+		name := p.rel
+		if i := strings.LastIndexByte(name, '/'); i != -1 {
+			name = name[i+1:]
+		}
+		return f.re.MatchString(name)
+	}
+}
+
+func (p *program) compilePathFilters() error {
+	for _, pattern := range p.args.excludes {
+		f, err := compilePathFilter(pattern, true)
+		if err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+		}
+		p.excludes = append(p.excludes, f)
+	}
+	for _, pattern := range p.args.includes {
+		f, err := compilePathFilter(pattern, false)
+		if err != nil {
+			return fmt.Errorf("invalid include pattern %q: %v", pattern, err)
+		}
+		p.includes = append(p.includes, f)
+	}
+	return nil
+}
+
+// isExcluded reports whether the file or directory matches any of the --exclude filters.
+func (p *program) isExcluded(path *walkedPath) bool {
+	for _, f := range p.excludes {
+		if f.match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIncluded reports whether the file matches any of the --include filters.
+// Directories are never checked, since their files can still match.
+func (p *program) isIncluded(path *walkedPath) bool {
+	if len(p.includes) == 0 {
+		return true
+	}
+	for _, f := range p.includes {
+		if f.match(path) {
+			return true
+		}
+	}
+	return false
+}
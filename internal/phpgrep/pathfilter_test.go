@@ -0,0 +1,89 @@
+package phpgrep
+
+import (
+	"testing"
+)
+
+func TestPathFilter(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		isDir   bool
+		matches bool
+	}{
+		{pattern: "glob:src/**", rel: "src/a.php", matches: true},
+		{pattern: "glob:src/**", rel: "src/a/b.php", matches: true},
+		{pattern: "glob:src/**", rel: "lib/src/a.php", matches: false},
+		{pattern: "glob:**/Tests/**", rel: "Tests/a.php", matches: true},
+		{pattern: "glob:**/Tests/**", rel: "src/Foo/Tests/a.php", matches: true},
+		{pattern: "glob:**/Tests/**", rel: "src/FooTests/a.php", matches: false},
+		{pattern: "glob:*Test.php", rel: "src/FooTest.php", matches: true},
+		{pattern: "glob:*Test.php", rel: "src/FooTest.php.bak", matches: false},
+		{pattern: "glob:cache/", rel: "var/cache", isDir: true, matches: true},
+		{pattern: "glob:cache/", rel: "var/cache", isDir: false, matches: false},
+		{pattern: "glob:/src", rel: "src", isDir: true, matches: true},
+		{pattern: "glob:/src", rel: "lib/src", isDir: true, matches: false},
+		{pattern: "glob:src/?.php", rel: "src/a.php", matches: true},
+		{pattern: "glob:src/?.php", rel: "src/ab.php", matches: false},
+		{pattern: `re:^src/.*\.inc$`, rel: "src/a/b.inc", matches: true},
+		{pattern: `re:^src/.*\.inc$`, rel: "lib/src/b.inc", matches: false},
+		// Unlike the globs, regexps without slashes are matched against the whole path.
+		{pattern: `re:^b\.inc$`, rel: "src/b.inc", matches: false},
+		{pattern: `re:\.inc$`, rel: "src/b.inc", matches: true},
+		// Unprefixed --include patterns are globs.
+		{pattern: "src/**", rel: "src/a/b.php", matches: true},
+		{pattern: "src/**", rel: "lib/src/a.php", matches: false},
+		{pattern: "*Test.php", rel: "src/FooTest.php", matches: true},
+	}
+
+	for _, test := range tests {
+		f, err := compilePathFilter(test.pattern, false)
+		if err != nil {
+			t.Errorf("compile %q: %v", test.pattern, err)
+			continue
+		}
+		have := f.match(&walkedPath{path: test.rel, rel: test.rel, isDir: test.isDir})
+		if have != test.matches {
+			t.Errorf("%q match %q (dir=%v): have %v, want %v", test.pattern, test.rel, test.isDir, have, test.matches)
+		}
+	}
+}
+
+func TestPathFilterKind(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		exclude  bool
+		absolute bool
+	}{
+		{pattern: "vendor/", exclude: true, absolute: true},
+		{pattern: "/vendor", exclude: true, absolute: true},
+		{pattern: ".*vendor.*", exclude: true, absolute: true},
+		{pattern: `\.test\.php$`, exclude: true, absolute: true},
+		{pattern: "(a|b)/*", exclude: true, absolute: true},
+		{pattern: "vendor/*", exclude: true, absolute: true},
+		{pattern: "a?.php", exclude: true, absolute: true},
+		// "**" and the invalid regexps make it a glob.
+		{pattern: "**/Tests/**", exclude: true, absolute: false},
+		{pattern: "src/**", exclude: true, absolute: false},
+		{pattern: "*.php", exclude: true, absolute: false},
+		{pattern: "glob:**/vendor/**", exclude: true, absolute: false},
+		{pattern: "glob:*.php", exclude: true, absolute: false},
+		{pattern: "glob:vendor", exclude: true, absolute: false},
+		{pattern: "re:vendor/", exclude: true, absolute: false},
+		// Unprefixed --include patterns are always globs.
+		{pattern: "vendor/", absolute: false},
+		{pattern: ".*vendor.*", absolute: false},
+		{pattern: "src/**", absolute: false},
+	}
+
+	for _, test := range tests {
+		f, err := compilePathFilter(test.pattern, test.exclude)
+		if err != nil {
+			t.Errorf("compile %q: %v", test.pattern, err)
+			continue
+		}
+		if f.absolute != test.absolute {
+			t.Errorf("%q: have absolute=%v, want %v", test.pattern, f.absolute, test.absolute)
+		}
+	}
+}
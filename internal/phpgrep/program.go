@@ -3,22 +3,22 @@ package phpgrep
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
 
-	"github.com/VKCOM/noverify/src/ir"
 	"github.com/VKCOM/noverify/src/ir/irconv"
 	"github.com/VKCOM/noverify/src/phpdoc"
 	"github.com/VKCOM/noverify/src/phpgrep"
@@ -32,26 +32,244 @@ type match struct {
 
 	filename string
 	line     int
+	endLine  int
 	startPos int
 	endPos   int
 
-	data phpgrep.MatchData
+	// captures are only collected if they're needed for the output.
+	captures []capture
+
+	// blame is only set if it's needed for the output.
+	blame *blameInfo
+
+	// owners is only set if it's needed for the output.
+	owners []string
+}
+
+type capture struct {
+	name     string
+	startPos int
+	endPos   int
+}
+
+func (m *match) matchText() string {
+	return m.text[m.matchStartOffset : m.matchStartOffset+m.matchLength]
+}
+
+func (m *match) captureText(c capture) string {
+	// Since we don't have file contents at this point, we can't
+	// do a simple contents[StartPos:EndPos].
+	// But we do know that all submatches located somewhere inside m.text.
+	begin := c.startPos - m.startPos + m.matchStartOffset
+	end := begin + (c.endPos - c.startPos)
+	return m.text[begin:end]
+}
+
+// If there are more than 100k results, something is wrong.
+// Most likely, a user pattern is too generic and needs adjustment.
+const maxLimit = 100000
+
+// matchLimit is shared between the workers, so they can stop
+// as soon as the --limit number of matches is collected.
+type matchLimit struct {
+	max int64
+
+	// reserved is the number of the collected matches, it never exceeds max.
+	reserved int64
+
+	// overflow is the number of the matches that were found
+	// after the limit was reached. They're discarded.
+	overflow int64
+}
+
+func (l *matchLimit) reserve() bool {
+	for {
+		n := atomic.LoadInt64(&l.reserved)
+		if n >= l.max {
+			atomic.AddInt64(&l.overflow, 1)
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.reserved, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (l *matchLimit) reached() bool {
+	return atomic.LoadInt64(&l.reserved) >= l.max
+}
+
+// release returns the reserved matches that were discarded.
+func (l *matchLimit) release(n int) {
+	atomic.AddInt64(&l.reserved, -int64(n))
+}
+
+// truncated reports whether some of the found matches were discarded.
+func (l *matchLimit) truncated() bool {
+	return atomic.LoadInt64(&l.overflow) > 0
+}
+
+// dropped returns the number of the found matches that were discarded.
+func (l *matchLimit) dropped() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.overflow)
+}
+
+// orderedLimit stops the --sort path search as soon as the first
+// --limit matches in the path order are known.
+//
+// The files are sent to the workers in the path order, so once the files
+// that precede the first unfinished file have enough matches,
+// the rest of the files can't change the results.
+type orderedLimit struct {
+	max       int64
+	filenames []string
+	index     map[string]int
+
+	mu    sync.Mutex
+	files []orderedFile
+	next  int   // The first unfinished file index
+	found int64 // The number of matches inside the files before next
+}
+
+type orderedFile struct {
+	pending int  // The file contents that are sent, but not grepped yet
+	sent    bool // All file contents are sent (an archive has several entries)
+	matches int
+}
+
+// newOrderedLimit creates the limit for the sorted list of the walked files.
+func newOrderedLimit(filenames []string, max int64) *orderedLimit {
+	l := &orderedLimit{max: max, index: make(map[string]int, len(filenames))}
+	for _, filename := range filenames {
+		// The same file can be walked twice if the targets overlap.
+		if _, ok := l.index[filename]; ok {
+			continue
+		}
+		l.index[filename] = len(l.filenames)
+		l.filenames = append(l.filenames, filename)
+	}
+	l.files = make([]orderedFile, len(l.filenames))
+	return l
+}
+
+// walk sends the files to the filenames channel in the path order.
+func (l *orderedLimit) walk(filenames chan<- string, stop <-chan struct{}) error {
+	for _, filename := range l.filenames {
+		select {
+		case filenames <- filename:
+		case <-stop:
+			return nil
+		}
+	}
+	return nil
+}
+
+// indexOf returns the walked file index or -1 if there is no limit.
+func (l *orderedLimit) indexOf(filename string) int {
+	if l == nil {
+		return -1
+	}
+	return l.index[filename]
+}
+
+// send is called before the file contents are sent to the workers.
+func (l *orderedLimit) send(i int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.files[i].pending++
+	l.mu.Unlock()
+}
+
+// finish is called after the file contents are grepped.
+func (l *orderedLimit) finish(i, numMatches int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.files[i].pending--
+	l.files[i].matches += numMatches
+	l.advance()
+	l.mu.Unlock()
+}
+
+// close is called after all walked file contents are sent.
+// numMatches are the matches restored from the checkpoint.
+func (l *orderedLimit) close(i, numMatches int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.files[i].sent = true
+	l.files[i].matches += numMatches
+	l.advance()
+	l.mu.Unlock()
+}
+
+func (l *orderedLimit) advance() {
+	for l.next < len(l.files) && l.files[l.next].sent && l.files[l.next].pending == 0 {
+		l.found += int64(l.files[l.next].matches)
+		l.next++
+	}
+}
+
+func (l *orderedLimit) reached() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.found >= l.max
 }
 
 type program struct {
 	args arguments
 
 	workers []*worker
+	limit   *matchLimit
+	stats   *searchStats
+
+	// stoppedEarly is set if the search was stopped after the --limit was reached.
+	stoppedEarly bool
+
+	checkpoint *checkpoint
+	skipped    *skippedFiles
+	generated  *generatedDetector
+	diff       *diffFilter
+	comparison *comparison
+	blame      *blameCache
+	owners     *codeowners
+
+	sectionExtractors map[string]sectionExtractor
+
+	maxFileSize int64
+
+	shardIndex int
+	shardCount int
 
 	excludeResults map[string][]int
 	filters        []phpgrepFilter
-	exclude        *regexp.Regexp
+	excludes       []*pathFilter
+	includes       []*pathFilter
 	outputTemplate *template.Template
 	matches        int64
 
 	cpuProfile bytes.Buffer
 }
 
+// validatePattern is separated from the validateFlags,
+// since the REPL mode reads the patterns later.
+func (p *program) validatePattern() error {
+	if p.args.pattern == "" {
+		return fmt.Errorf("pattern can't be empty")
+	}
+	return nil
+}
+
 func (p *program) validateFlags() error {
 	if p.args.workers < 1 {
 		return fmt.Errorf("workers value can't be less than 1")
@@ -60,12 +278,9 @@ func (p *program) validateFlags() error {
 		// Users won't notice.
 		p.args.workers = 128
 	}
-	if p.args.targets == "" {
+	if p.args.targets == "" && p.args.filesFrom == "" {
 		return fmt.Errorf("target can't be empty")
 	}
-	if p.args.pattern == "" {
-		return fmt.Errorf("pattern can't be empty")
-	}
 	if p.args.format == "" {
 		return fmt.Errorf("format can't be empty")
 	}
@@ -78,15 +293,104 @@ func (p *program) validateFlags() error {
 	if _, err := colorizeText("", p.args.matchColor); err != nil {
 		return fmt.Errorf("color-match: %v", err)
 	}
+	if p.args.diffBase != "" && p.args.diffFile != "" {
+		return fmt.Errorf("--diff-base and --diff-file can't be used together")
+	}
+	if (p.args.diffBase != "" || p.args.diffFile != "") && p.args.filesFrom != "" {
+		return fmt.Errorf("--files-from can't be combined with --diff-base or --diff-file")
+	}
+	if err := p.validateStdinTarget(); err != nil {
+		return err
+	}
+	if err := p.validateCompareFlags(); err != nil {
+		return err
+	}
+	if err := p.validateArchiveTargets(); err != nil {
+		return err
+	}
+	switch p.args.groupBy {
+	case "", "owner":
+		// OK.
+	default:
+		return fmt.Errorf("group-by: unexpected group %q", p.args.groupBy)
+	}
+	if p.args.groupBy != "" {
+		if p.args.replace || p.args.tui || p.args.watch || p.args.compareRev != "" {
+			return fmt.Errorf("--group-by can't be combined with -i, --tui, --watch or --compare-rev")
+		}
+		// Checkpoints don't keep the matches of the processed files.
+		if p.args.checkpoint != "" {
+			return fmt.Errorf("--group-by can't be combined with --checkpoint")
+		}
+	}
+	if p.args.shard != "" {
+		var err error
+		p.shardIndex, p.shardCount, err = parseShard(p.args.shard)
+		if err != nil {
+			return fmt.Errorf("shard: %v", err)
+		}
+	}
+	if p.args.json && (p.args.replace || p.args.tui || p.args.watch) {
+		return fmt.Errorf("--json can't be combined with -i, --tui or --watch")
+	}
+	if p.args.stats {
+		switch p.args.statsFormat {
+		case "text", "json":
+			// OK.
+		default:
+			return fmt.Errorf("stats-format: unexpected format %q", p.args.statsFormat)
+		}
+		p.stats = &searchStats{startTime: time.Now()}
+	}
+	switch p.args.sort {
+	case "path", "none":
+		// OK.
+	default:
+		return fmt.Errorf("sort: unexpected mode %q", p.args.sort)
+	}
 	switch p.args.progressMode {
 	case "none", "append", "update":
 		// OK.
 	default:
 		return fmt.Errorf("progress: unexpected mode %q", p.args.progressMode)
 	}
-	// If there are more than 100k results, something is wrong.
-	// Most likely, a user pattern is too generic and needs adjustment.
-	const maxLimit = 100000
+	if p.args.tui && p.args.watch {
+		return fmt.Errorf("terminal UI can't be combined with --watch")
+	}
+	if p.args.maxFileSize != "" {
+		size, err := parseByteSize(p.args.maxFileSize)
+		if err != nil {
+			return fmt.Errorf("max-file-size: %v", err)
+		}
+		p.maxFileSize = size
+	}
+	if p.args.fileTimeout < 0 {
+		return fmt.Errorf("file-timeout can't be negative")
+	}
+	p.skipped = &skippedFiles{}
+	if p.args.checkpoint != "" && p.args.checkpointInterval <= 0 {
+		return fmt.Errorf("checkpoint-interval should be positive")
+	}
+	if p.args.watch {
+		if p.args.replace {
+			return fmt.Errorf("watch mode can't be combined with -i")
+		}
+		switch p.args.watchPrint {
+		case "delta", "all":
+			// OK.
+		default:
+			return fmt.Errorf("watch-print: unexpected mode %q", p.args.watchPrint)
+		}
+		if p.args.filesFrom == "-" {
+			return fmt.Errorf("watch mode can't read the files list from stdin")
+		}
+		if p.args.diffBase != "" || p.args.diffFile != "" {
+			return fmt.Errorf("watch mode can't be combined with --diff-base or --diff-file")
+		}
+		if p.args.watchInterval <= 0 {
+			return fmt.Errorf("watch-interval should be positive")
+		}
+	}
 	if p.args.limit == 0 || p.args.limit > maxLimit {
 		p.args.limit = maxLimit
 	}
@@ -94,6 +398,7 @@ func (p *program) validateFlags() error {
 	for _, e := range strings.Split(p.args.phpFileExt, ",") {
 		p.args.phpFileExtList = append(p.args.phpFileExtList, "."+strings.TrimSpace(e))
 	}
+	p.compileSectionExtractors()
 
 	return nil
 }
@@ -165,8 +470,32 @@ func (p *program) compilePattern() error {
 	}
 
 	deps := inspectFormatDeps(p.args.format)
-	needMatchData := deps.capture
-	needMatchLine := deps.matchLine
+	if err := checkCaptureNames(p.args.pattern, deps); err != nil {
+		return err
+	}
+	// Terminal UI highlights the captures.
+	// JSON report includes everything.
+	needMatchData := deps.capture || p.args.tui || p.args.json
+	needMatchLine := deps.matchLine || p.args.json
+
+	var cache *resultsCache
+	if p.args.cacheDir != "" {
+		cache, err = newResultsCache(p.args.cacheDir, p.cacheConfig(needMatchData, needMatchLine)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// When the results are sorted, the first N matches can be located
+	// in the files we haven't seen yet, see orderedLimit.
+	if p.args.sort == "none" && !p.needAllMatches() {
+		p.limit = &matchLimit{max: int64(p.args.limit)}
+	}
+
+	var parseSlots chan struct{}
+	if p.args.fileTimeout != 0 {
+		parseSlots = newParseSlots(p.args.workers)
+	}
 
 	p.workers = make([]*worker, p.args.workers)
 	for i := range p.workers {
@@ -176,6 +505,16 @@ func (p *program) compilePattern() error {
 			filters:        filters,
 			excludeResults: p.excludeResults,
 			irconv:         irconv.NewConverter(phpdoc.NewTypeParser()),
+			literals:       newLiteralFilter(p.args.pattern, p.args.caseSensitive, !p.args.strictSyntax),
+			cache:          cache,
+			limit:          p.limit,
+			skipped:        p.skipped,
+			generated:      p.generated,
+			sections:       p.sectionExtractors,
+			diff:           p.diff,
+			maxFileSize:    p.maxFileSize,
+			fileTimeout:    p.args.fileTimeout,
+			parseSlots:     parseSlots,
 			needMatchData:  needMatchData,
 			needMatchLine:  needMatchLine,
 		}
@@ -184,23 +523,15 @@ func (p *program) compilePattern() error {
 	return nil
 }
 
-func (p *program) compileExcludePattern() error {
-	if p.args.exclude == "" {
-		return nil
-	}
-	var err error
-	p.exclude, err = regexp.Compile(p.args.exclude)
-	if err != nil {
-		return fmt.Errorf("invalid exclude regexp: %v", err)
-	}
-	return nil
-}
-
 func (p *program) compileExcludeResults() error {
 	if p.args.excludeResults == "" {
 		return nil
 	}
 	data, err := os.ReadFile(p.args.excludeResults)
+	if os.IsNotExist(err) && p.args.tui {
+		// Terminal UI will create it when needed.
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("can't read exclude-results file: %v", err)
 	}
@@ -232,58 +563,135 @@ func (p *program) compileOutputFormat() error {
 	if err != nil {
 		return err
 	}
+	if p.args.blame || (inspectFormatDeps(format).blame && !p.args.json) {
+		p.blame = newBlameCache()
+	}
 	return nil
 }
 
 func (p *program) printMatches() error {
-	if p.args.replace {
+	if p.args.replace || p.args.tui {
 		return nil
 	}
+	if p.args.json {
+		return p.printJSONReport()
+	}
+	if p.comparison != nil {
+		return p.printComparison()
+	}
+	if p.args.groupBy == "owner" {
+		p.printOwnerCounts()
+		p.printSkippedFiles()
+		return nil
+	}
+	matches := p.collectMatches()
+	if uint(len(matches)) > p.args.limit {
+		p.annotateMatches(matches[:p.args.limit], "")
+	} else {
+		p.annotateMatches(matches, "")
+	}
 	printed := uint(0)
-	for _, w := range p.workers {
-		for _, m := range w.matches {
-			if err := printMatch(p.outputTemplate, &p.args, m); err != nil {
-				return err
-			}
-			printed++
-			if printed >= p.args.limit {
-				log.Printf("results limited to %d matches", p.args.limit)
-				return nil
-			}
+	for _, m := range matches {
+		if printed >= p.args.limit {
+			break
 		}
+		if err := printMatch(p.outputTemplate, &p.args, m); err != nil {
+			return err
+		}
+		printed++
+	}
+
+	found := uint(p.matches + p.limit.dropped())
+	switch {
+	case p.stoppedEarly && found > printed:
+		log.Printf("results limited to %d matches, the search was stopped early (found at least %d, %d dropped)",
+			printed, found, found-printed)
+	case found > printed:
+		log.Printf("results limited to %d matches (found %d, %d truncated)",
+			printed, found, found-printed)
+	default:
+		log.Printf("found %d matches", printed)
 	}
-	log.Printf("found %d matches", printed)
+	p.printSkippedFiles()
 	return nil
 }
 
+// needAllMatches reports whether the search can't be stopped or truncated
+// after the --limit number of matches is found. Compared and watched results
+// need all matches, even though only the --limit of them are printed.
+func (p *program) needAllMatches() bool {
+	return p.args.compareRev != "" || p.args.watch
+}
+
+// canStopInPathOrder reports whether the orderedLimit can be used.
+func (p *program) canStopInPathOrder() bool {
+	// The owner counts need all matches too.
+	if p.args.sort != "path" || p.needAllMatches() || p.args.groupBy != "" {
+		return false
+	}
+	// All files are walked before the search, so the results are delayed
+	// until the entire tree is walked. It's only worth it for the explicit --limit.
+	if !p.args.limitSet || p.args.limit >= maxLimit {
+		return false
+	}
+	// The stdin file name is not known until it's read.
+	return countStdinTargets(p.args.targets) == 0
+}
+
+// annotateMatches sets the optional blame and owners info that is needed for the output.
+// rev is the revision the matches were found in, it's empty for the working tree.
+func (p *program) annotateMatches(matches []match, rev string) {
+	p.annotateBlame(matches, rev)
+	p.annotateOwners(matches)
+}
+
+// collectMatches returns all matches found by the workers in the --sort order.
+func (p *program) collectMatches() []match {
+	var matches []match
+	for _, w := range p.workers {
+		matches = append(matches, w.matches...)
+	}
+	if p.args.sort == "path" {
+		sortMatches(matches)
+	}
+	return matches
+}
+
+func sortMatches(matches []match) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].filename != matches[j].filename {
+			return matches[i].filename < matches[j].filename
+		}
+		return matches[i].startPos < matches[j].startPos
+	})
+}
+
 func (p *program) replaceMatches() error {
-	if !p.args.replace {
+	if !p.args.replace || p.args.tui {
 		return nil
 	}
 	editsByFilename := make(map[string][]quickfix.TextEdit)
 	replaced := uint(0)
-	for _, w := range p.workers {
-		for _, m := range w.matches {
-			replacement, err := renderTemplate(m, renderConfig{
-				tmpl:        p.outputTemplate,
-				colors:      false,
-				multiline:   true,
-				absFilename: false,
-				args:        &p.args,
-			})
-			if err != nil {
-				return err
-			}
-			editsByFilename[m.filename] = append(editsByFilename[m.filename], quickfix.TextEdit{
-				StartPos:    m.startPos,
-				EndPos:      m.endPos,
-				Replacement: replacement,
-			})
-			replaced++
-			if replaced >= p.args.limit {
-				log.Printf("too many matches (%d), increase the --limit argument", p.args.limit)
-				return nil
-			}
+	for _, m := range p.collectMatches() {
+		replacement, err := renderTemplate(m, renderConfig{
+			tmpl:        p.outputTemplate,
+			colors:      false,
+			multiline:   true,
+			absFilename: false,
+			args:        &p.args,
+		})
+		if err != nil {
+			return err
+		}
+		editsByFilename[m.filename] = append(editsByFilename[m.filename], quickfix.TextEdit{
+			StartPos:    m.startPos,
+			EndPos:      m.endPos,
+			Replacement: replacement,
+		})
+		replaced++
+		if replaced >= p.args.limit {
+			log.Printf("too many matches (%d), increase the --limit argument", p.args.limit)
+			return nil
 		}
 	}
 	for filename, fixes := range editsByFilename {
@@ -299,130 +707,240 @@ func (p *program) replaceMatches() error {
 	return nil
 }
 
+type fileContents struct {
+	filename string
+	data     []byte
+
+	// tooLarge is set instead of reading the data
+	// if the file exceeds --max-file-size.
+	tooLarge bool
+	size     int64
+
+	// index is the walked file index for the orderedLimit.
+	index int
+}
+
 func (p *program) executePattern() error {
-	filenameQueue := make(chan string)
-	ticker := time.NewTicker(time.Second)
+	// The files are walked, read and grepped concurrently.
+	// All queues are bounded, so we never keep too many files in memory.
+	filenameQueue := make(chan string, p.args.workers)
+	fileQueue := make(chan fileContents, p.args.workers)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var filesProcessed int64
+	stopSearch := func() {
+		stopOnce.Do(func() {
+			p.stoppedEarly = true
+			close(stop)
+		})
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(p.workers))
-	defer func() {
-		close(filenameQueue)
-		ticker.Stop()
-		wg.Wait()
-		if p.args.progressMode == "update" {
-			os.Stderr.WriteString("\n")
+	// In --sort path mode, all files are walked before the search,
+	// so they can be searched in the path order.
+	var order *orderedLimit
+	if p.canStopInPathOrder() {
+		filenames, err := p.collectPHPFiles()
+		if err != nil {
+			return err
 		}
-		for _, w := range p.workers {
-			for _, err := range w.errors {
-				log.Print(err)
-			}
+		order = newOrderedLimit(filenames, int64(p.args.limit))
+	}
+
+	var errorsMu sync.Mutex
+	var errors []string
+	reportError := func(filename string, err error) {
+		msg := fmt.Sprintf("error: execute pattern: %s: %v", filename, err)
+		if p.args.progressMode != "update" {
+			log.Print(msg)
+			return
 		}
+		errorsMu.Lock()
+		errors = append(errors, msg)
+		errorsMu.Unlock()
+	}
+
+	walkErr := make(chan error, 1)
+	go func() {
+		if order != nil {
+			walkErr <- order.walk(filenameQueue, stop)
+		} else {
+			walkErr <- p.walkFiles(filenameQueue, stop)
+		}
+		close(filenameQueue)
+	}()
+
+	var readersWg sync.WaitGroup
+	readersWg.Add(p.args.workers)
+	for i := 0; i < p.args.workers; i++ {
+		go func() {
+			defer readersWg.Done()
+			for filename := range filenameQueue {
+				index := order.indexOf(filename)
+				if isArchiveFile(filename) {
+					restored := 0
+					err := p.readArchive(filename, func(f fileContents) {
+						if p.checkpoint.isProcessed(f.filename) {
+							restored += p.checkpoint.restoredMatches(f.filename)
+							return
+						}
+						p.stats.countBytesRead(len(f.data))
+						f.index = index
+						order.send(index)
+						fileQueue <- f
+					})
+					if err != nil {
+						reportError(filename, fmt.Errorf("read archive: %v", err))
+					}
+					order.close(index, restored)
+					if order.reached() {
+						stopSearch()
+					}
+					continue
+				}
+				if p.checkpoint.isProcessed(filename) {
+					order.close(index, p.checkpoint.restoredMatches(filename))
+					if order.reached() {
+						stopSearch()
+					}
+					continue
+				}
+				f, err := p.readFileContents(filename)
+				if err != nil {
+					reportError(filename, fmt.Errorf("read file: %v", err))
+					order.close(index, 0)
+					continue
+				}
+				p.stats.countBytesRead(len(f.data))
+				f.index = index
+				// The file is closed before it's sent, so its matches are
+				// counted as soon as the worker is finished with it.
+				order.send(index)
+				order.close(index, 0)
+				fileQueue <- f
+			}
+		}()
+	}
+	go func() {
+		readersWg.Wait()
+		close(fileQueue)
 	}()
 
+	var wg sync.WaitGroup
+	wg.Add(len(p.workers))
 	for _, w := range p.workers {
 		go func(w *worker) {
 			defer wg.Done()
 
-			for filename := range filenameQueue {
+			for f := range fileQueue {
+				// The files that are left in the queue come
+				// after the first --limit matches in the path order.
+				if order.reached() {
+					continue
+				}
 				if p.args.verbose {
-					log.Printf("debug: worker#%d greps %q file", w.id, filename)
+					log.Printf("debug: worker#%d greps %q file", w.id, f.filename)
 				}
 
-				numMatches, err := w.grepFile(filename)
+				if f.tooLarge {
+					w.checkFileSize(f.filename, f.size)
+					order.finish(f.index, 0)
+					continue
+				}
+				numMatches, err := w.grepData(f.filename, f.data)
+				atomic.AddInt64(&filesProcessed, 1)
 				if err != nil {
-					msg := fmt.Sprintf("error: execute pattern: %s: %v", filename, err)
-					if p.args.progressMode == "update" {
-						w.errors = append(w.errors, msg)
-					} else {
-						log.Print(msg)
-					}
+					reportError(f.filename, err)
+					order.finish(f.index, 0)
 					continue
 				}
+				if !w.stopped {
+					p.checkpoint.record(f.filename, w.matches[len(w.matches)-numMatches:], w.fileSkips)
+				}
+				order.finish(f.index, numMatches)
+				if order.reached() || (p.limit != nil && p.limit.reached()) {
+					stopSearch()
+				}
 				if numMatches == 0 {
 					continue
 				}
 
 				atomic.AddInt64(&p.matches, int64(numMatches))
+				p.owners.countMatches(f.filename, numMatches)
+				if p.args.sort == "path" && !p.needAllMatches() {
+					w.truncateMatches(int(p.args.limit))
+				}
 			}
 		}(w)
 	}
 
-	for _, target := range strings.Split(p.args.targets, ",") {
-		target = strings.TrimSpace(target)
-		if err := p.walkTarget(target, filenameQueue, ticker); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
 
-func (p *program) walkTarget(target string, filenameQueue chan<- string, ticker *time.Ticker) error {
-	phpExtensions := p.args.phpFileExtList
-	isPHPFile := func(name string) bool {
-		for _, ext := range phpExtensions {
-			if strings.HasSuffix(name, ext) {
-				return true
-			}
-		}
-		return false
+	// A nil channel blocks forever, so the checkpoint cases
+	// are never selected if there is no checkpoint.
+	var checkpointTicks <-chan time.Time
+	var interrupt chan os.Signal
+	if p.checkpoint != nil {
+		checkpointTicker := time.NewTicker(p.args.checkpointInterval)
+		defer checkpointTicker.Stop()
+		checkpointTicks = checkpointTicker.C
+		interrupt = make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(interrupt)
 	}
 
-	// TODO: use NoVerify workspace walking code?
-	filesProcessed := 0
-	err := filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		numMatches := atomic.LoadInt64(&p.matches)
-		if numMatches > int64(p.args.limit) {
-			return io.EOF
-		}
-
-		if p.exclude != nil {
-			fullName, err := filepath.Abs(path)
-			if err != nil {
-				log.Printf("error: abs(%s): %v", path, err)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-workersDone:
+			running = false
+		case <-checkpointTicks:
+			if err := p.checkpoint.save(); err != nil {
+				log.Printf("error: save checkpoint: %v", err)
+			}
+		case sig := <-interrupt:
+			if p.args.progressMode == "update" {
+				os.Stderr.WriteString("\n")
 			}
-			skip := p.exclude.MatchString(fullName)
-			if skip && info.IsDir() {
-				return filepath.SkipDir
+			if err := p.checkpoint.save(); err != nil {
+				return fmt.Errorf("interrupted by %v, save checkpoint: %v", sig, err)
 			}
-			if skip {
-				return nil
+			return fmt.Errorf("interrupted by %v, run the same command to continue from %s", sig, p.checkpoint.filename)
+		case <-ticker.C:
+			numMatches := atomic.LoadInt64(&p.matches)
+			numFiles := atomic.LoadInt64(&filesProcessed)
+			switch p.args.progressMode {
+			case "append":
+				fmt.Fprintf(os.Stderr, "%d matches so far, processed %d files\n", numMatches, numFiles)
+			case "update":
+				fmt.Fprintf(os.Stderr, "\r%d matches so far, processed %d files", numMatches, numFiles)
+			case "none":
+				// Do nothing.
 			}
 		}
+	}
 
-		if info.IsDir() {
-			return nil
-		}
-		if !isPHPFile(info.Name()) {
-			return nil
-		}
+	if p.args.progressMode == "update" {
+		os.Stderr.WriteString("\n")
+	}
+	for _, msg := range errors {
+		log.Print(msg)
+	}
 
-		for {
-			select {
-			case filenameQueue <- path:
-				filesProcessed++
-				return nil
-			case <-ticker.C:
-				switch p.args.progressMode {
-				case "append":
-					fmt.Fprintf(os.Stderr, "%d matches so far, processed %d files\n", numMatches, filesProcessed)
-				case "update":
-					fmt.Fprintf(os.Stderr, "\r%d matches so far, processed %d files", numMatches, filesProcessed)
-				case "none":
-					// Do nothing.
-				}
-			}
+	if err := <-walkErr; err != nil {
+		if err := p.checkpoint.save(); err != nil {
+			log.Printf("error: save checkpoint: %v", err)
 		}
-	})
-	if err == io.EOF {
-		return nil
+		return err
 	}
-
-	return err
+	if err := p.checkpoint.remove(); err != nil {
+		log.Printf("error: remove checkpoint: %v", err)
+	}
+	return nil
 }
 
 func mustColorizeText(s, color string) string {
@@ -485,7 +1003,7 @@ type renderConfig struct {
 }
 
 func renderTemplate(m match, config renderConfig) (string, error) {
-	matchText := m.text[m.matchStartOffset : m.matchStartOffset+m.matchLength]
+	matchText := m.matchText()
 	filename := m.filename
 	if config.absFilename {
 		abs, err := filepath.Abs(filename)
@@ -497,18 +1015,8 @@ func renderTemplate(m match, config renderConfig) (string, error) {
 
 	data := make(map[string]interface{}, 3)
 	// If we captured anything, add submatches as map elements.
-	if len(m.data.Capture) != 0 {
-		pos := ir.GetPosition(m.data.Node)
-		for _, capture := range m.data.Capture {
-			// Since we don't have file contents at this point, we can't
-			// do a simple contents[StartPos:EndPos].
-			// But we do know that all submatches located somewhere inside m.text.
-			capturePos := ir.GetPosition(capture.Node)
-			width := capturePos.EndPos - capturePos.StartPos
-			begin := capturePos.StartPos - pos.StartPos
-			end := begin + width
-			data[capture.Name] = m.text[begin:end]
-		}
+	for _, c := range m.captures {
+		data[c.name] = m.captureText(c)
 	}
 
 	// Assign these after the captures so they overwrite them in case of collisions.
@@ -516,6 +1024,14 @@ func renderTemplate(m match, config renderConfig) (string, error) {
 	data["Line"] = m.line
 	data["Match"] = matchText
 	data["MatchLine"] = m.text
+	if m.blame != nil {
+		data["Author"] = m.blame.author
+		data["Commit"] = m.blame.commit
+		data["AuthorDate"] = m.blame.authorDate
+	}
+	if m.owners != nil {
+		data["Owners"] = strings.Join(m.owners, " ")
+	}
 
 	if config.colors {
 		data["Filename"] = mustColorizeText(filename, config.args.filenameColor)
@@ -538,16 +1054,20 @@ func renderTemplate(m match, config renderConfig) (string, error) {
 }
 
 func printMatch(tmpl *template.Template, args *arguments, m match) error {
-	s, err := renderTemplate(m, renderConfig{
+	s, err := formatMatch(tmpl, args, m)
+	if err != nil {
+		return err
+	}
+	fmt.Println(s)
+	return nil
+}
+
+func formatMatch(tmpl *template.Template, args *arguments, m match) (string, error) {
+	return renderTemplate(m, renderConfig{
 		tmpl:        tmpl,
 		colors:      !args.noColor,
 		multiline:   args.multiline,
 		absFilename: args.abs,
 		args:        args,
 	})
-	if err != nil {
-		return err
-	}
-	fmt.Println(s)
-	return nil
 }
@@ -0,0 +1,245 @@
+package phpgrep
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOrderedLimit(t *testing.T) {
+	type event struct {
+		op         string // "send", "close" or "finish"
+		filename   string
+		numMatches int
+		reached    bool
+	}
+	tests := []struct {
+		name      string
+		filenames []string
+		max       int64
+		events    []event
+	}{
+		{
+			name:      "in order",
+			filenames: []string{"a.php", "b.php", "c.php"},
+			max:       3,
+			events: []event{
+				{op: "send", filename: "a.php"},
+				{op: "close", filename: "a.php"},
+				{op: "finish", filename: "a.php", numMatches: 2},
+				{op: "send", filename: "b.php"},
+				{op: "close", filename: "b.php"},
+				{op: "finish", filename: "b.php", numMatches: 1, reached: true},
+			},
+		},
+		{
+			name:      "later file finished first",
+			filenames: []string{"a.php", "b.php", "c.php"},
+			max:       2,
+			events: []event{
+				{op: "send", filename: "a.php"},
+				{op: "close", filename: "a.php"},
+				{op: "send", filename: "b.php"},
+				{op: "close", filename: "b.php"},
+				// b.php matches don't count until a.php is finished.
+				{op: "finish", filename: "b.php", numMatches: 5},
+				{op: "finish", filename: "a.php", numMatches: 0, reached: true},
+			},
+		},
+		{
+			name:      "archive entries",
+			filenames: []string{"a.phar", "b.php"},
+			max:       2,
+			events: []event{
+				{op: "send", filename: "a.phar"},
+				{op: "send", filename: "a.phar"},
+				{op: "finish", filename: "a.phar", numMatches: 1},
+				{op: "finish", filename: "a.phar", numMatches: 1},
+				// The archive can have more entries until it's closed.
+				{op: "close", filename: "a.phar", reached: true},
+			},
+		},
+		{
+			name: "restored from checkpoint",
+			// Overlapping targets walk the same file twice.
+			filenames: []string{"a.php", "a.php", "b.php", "c.php"},
+			max:       2,
+			events: []event{
+				{op: "close", filename: "a.php", numMatches: 1},
+				{op: "close", filename: "b.php", numMatches: 1, reached: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		l := newOrderedLimit(test.filenames, test.max)
+		for i, e := range test.events {
+			index := l.indexOf(e.filename)
+			switch e.op {
+			case "send":
+				l.send(index)
+			case "close":
+				l.close(index, e.numMatches)
+			case "finish":
+				l.finish(index, e.numMatches)
+			}
+			if have := l.reached(); have != e.reached {
+				t.Errorf("%s: event %d: reached=%v, want %v", test.name, i, have, e.reached)
+			}
+		}
+	}
+}
+
+func TestCanStopInPathOrder(t *testing.T) {
+	tests := []struct {
+		args arguments
+		want bool
+	}{
+		{arguments{sort: "path", targets: ".", limit: 10, limitSet: true}, true},
+		{arguments{sort: "path", targets: ".", limit: 1000}, false},
+		{arguments{sort: "path", targets: ".", limit: maxLimit, limitSet: true}, false},
+		{arguments{sort: "none", targets: ".", limit: 10, limitSet: true}, false},
+		{arguments{sort: "path", targets: ".", limit: 10, limitSet: true, watch: true}, false},
+		{arguments{sort: "path", targets: ".", limit: 10, limitSet: true, compareRev: "main"}, false},
+		{arguments{sort: "path", targets: ".", limit: 10, limitSet: true, groupBy: "owner"}, false},
+		{arguments{sort: "path", targets: "-,src", limit: 10, limitSet: true}, false},
+	}
+	for _, test := range tests {
+		p := &program{args: test.args}
+		if have := p.canStopInPathOrder(); have != test.want {
+			t.Errorf("%+v: have %v, want %v", test.args, have, test.want)
+		}
+	}
+}
+
+// matchPositions formats the matches as "filename:line:column" strings.
+func matchPositions(matches []match) []string {
+	var result []string
+	for _, m := range matches {
+		result = append(result, fmt.Sprintf("%s:%d:%d", m.filename, m.line, m.startPos))
+	}
+	return result
+}
+
+func TestSortMatches(t *testing.T) {
+	tests := []struct {
+		matches []match
+		want    []string
+	}{
+		{
+			matches: nil,
+			want:    nil,
+		},
+		{
+			matches: []match{
+				{filename: "b.php", line: 1, startPos: 6},
+				{filename: "a.php", line: 3, startPos: 20},
+				{filename: "a.php", line: 1, startPos: 6},
+				{filename: "a/b.php", line: 1, startPos: 6},
+			},
+			want: []string{"a.php:1:6", "a.php:3:20", "a/b.php:1:6", "b.php:1:6"},
+		},
+		{
+			// The same line matches are sorted by the column.
+			matches: []match{
+				{filename: "a.php", line: 2, startPos: 15},
+				{filename: "a.php", line: 2, startPos: 9},
+				{filename: "a.php", line: 1, startPos: 6},
+			},
+			want: []string{"a.php:1:6", "a.php:2:9", "a.php:2:15"},
+		},
+	}
+
+	for _, test := range tests {
+		before := matchPositions(test.matches)
+		sortMatches(test.matches)
+		if diff := cmp.Diff(test.want, matchPositions(test.matches)); diff != "" {
+			t.Errorf("sort(%q) mismatch (-want +have):\n%s", before, diff)
+		}
+	}
+
+	// The nested matches keep their order.
+	nested := []match{
+		{filename: "a.php", line: 1, startPos: 6, endPos: 20},
+		{filename: "a.php", line: 1, startPos: 6, endPos: 10},
+	}
+	sortMatches(nested)
+	if nested[0].endPos != 20 {
+		t.Errorf("the sort is not stable")
+	}
+}
+
+func TestCollectMatches(t *testing.T) {
+	workers := []*worker{
+		{matches: []match{{filename: "b.php", line: 2}, {filename: "b.php", line: 1}}},
+		{matches: []match{{filename: "a.php", line: 1}}},
+	}
+	for i := range workers[0].matches {
+		workers[0].matches[i].startPos = workers[0].matches[i].line * 10
+	}
+
+	tests := []struct {
+		sort string
+		want []string
+	}{
+		{sort: "path", want: []string{"a.php:1:0", "b.php:1:10", "b.php:2:20"}},
+		// The workers order is kept as is.
+		{sort: "none", want: []string{"b.php:2:20", "b.php:1:10", "a.php:1:0"}},
+	}
+	for _, test := range tests {
+		p := &program{args: arguments{sort: test.sort}}
+		for _, w := range workers {
+			w := *w
+			w.matches = append([]match(nil), w.matches...)
+			p.workers = append(p.workers, &w)
+		}
+		if diff := cmp.Diff(test.want, matchPositions(p.collectMatches())); diff != "" {
+			t.Errorf("sort=%s: matches mismatch (-want +have):\n%s", test.sort, diff)
+		}
+	}
+}
+
+func TestMatchLimit(t *testing.T) {
+	l := &matchLimit{max: 2}
+	w := &worker{limit: l}
+	for i := 0; i < 2; i++ {
+		if !w.reserveMatch() {
+			t.Fatalf("match %d is not reserved", i)
+		}
+	}
+	if !l.reached() || l.truncated() || w.stopped {
+		t.Errorf("have reached=%v truncated=%v stopped=%v, want true false false", l.reached(), l.truncated(), w.stopped)
+	}
+	if w.reserveMatch() {
+		t.Errorf("match over the limit is reserved")
+	}
+	if !w.stopped || l.dropped() != 1 {
+		t.Errorf("have stopped=%v dropped=%d, want true 1", w.stopped, l.dropped())
+	}
+	// The dropped match is still counted after the release.
+	l.release(2)
+	if l.reached() || l.dropped() != 1 {
+		t.Errorf("have reached=%v dropped=%d after the release", l.reached(), l.dropped())
+	}
+	// The stopped worker resumes once there is room for more matches.
+	if _, err := w.grepData("a.php", nil); err != nil || w.stopped {
+		t.Errorf("have stopped=%v (err=%v) after the release", w.stopped, err)
+	}
+	for i := 0; i < 2; i++ {
+		if !w.reserveMatch() {
+			t.Fatalf("match %d is not reserved after the release", i)
+		}
+	}
+	if w.reserveMatch() || l.dropped() != 2 {
+		t.Errorf("have dropped=%d, want 2", l.dropped())
+	}
+
+	var nilLimit *matchLimit
+	if nilLimit.dropped() != 0 {
+		t.Errorf("nil limit drops matches")
+	}
+	if !(&worker{}).reserveMatch() {
+		t.Errorf("match is not reserved without a limit")
+	}
+}
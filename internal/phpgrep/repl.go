@@ -0,0 +1,435 @@
+package phpgrep
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VKCOM/noverify/src/ir"
+	"github.com/VKCOM/noverify/src/ir/irconv"
+	"github.com/VKCOM/noverify/src/phpdoc"
+)
+
+const replHelp = `Enter a pattern to run it against the parsed targets.
+Lines that start with ":" are commands:
+  :filter [filter]  add a filter (like "x=1,2"); clear all filters if no argument given
+  :format [format]  set the output format; reset it to the default if no argument given
+  :show N           print first N results for every pattern (default 10)
+  :history          print the entered lines history
+  :redo N           run the history entry N once again
+  :export [rule]    print the current search as a phpgrep command line or as a JSON rule entry
+  :help             print this help message
+  :quit             exit the REPL`
+
+// parsedFile is a REPL target file that is parsed once.
+// The files with code sections have a root per section.
+type parsedFile struct {
+	filename string
+	data     []byte
+	roots    []parsedRoot
+}
+
+type parsedRoot struct {
+	section *codeSection // Nil for the ordinary PHP files
+	root    *ir.Root
+}
+
+type replSession struct {
+	p *program
+
+	// args are the command line arguments as they were parsed,
+	// before the validation has changed them.
+	args arguments
+
+	defaultFormat string
+	show          int
+
+	files   []parsedFile
+	history []string
+}
+
+func newReplSession(args arguments) *replSession {
+	return &replSession{
+		p:             &program{args: args},
+		args:          args,
+		defaultFormat: args.format,
+		show:          10,
+	}
+}
+
+func replMain(argv []string) (int, error) {
+	var args arguments
+	fs := flag.NewFlagSet("phpgrep repl", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: phpgrep repl [flags...] targets\n\n%s\n\nSupported command-line flags:\n", replHelp)
+		fs.PrintDefaults()
+	}
+	bindFlags(fs, &args)
+	if err := fs.Parse(argv); err != nil {
+		return exitError, err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitError, fmt.Errorf("expected exactly 1 targets argument, found %d", fs.NArg())
+	}
+	args.targets = fs.Arg(0)
+
+	r := newReplSession(args)
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{"validate flags", r.validateFlags},
+		{"compile exclude results", r.p.compileExcludeResults},
+		{"compile path filters", r.p.compilePathFilters},
+		{"parse targets", r.parseTargets},
+	}
+	for _, step := range steps {
+		if err := step.fn(); err != nil {
+			return exitError, fmt.Errorf("%s: %v", step.name, err)
+		}
+	}
+
+	log.Printf("parsed %d files, type :help for the list of commands", len(r.files))
+	r.loop()
+	return exitMatched, nil
+}
+
+// validateFlags checks the REPL-specific restrictions,
+// the pattern is validated when it's entered.
+func (r *replSession) validateFlags() error {
+	args := &r.p.args
+	if args.replace || args.watch || args.filesFrom != "" {
+		return fmt.Errorf("-i, --watch and --files-from are not supported in the REPL mode")
+	}
+	if countStdinTargets(args.targets) != 0 {
+		// Stdin is used for the REPL commands.
+		return fmt.Errorf("stdin target is not supported in the REPL mode")
+	}
+	if hasArchiveTargets(args.targets) {
+		return fmt.Errorf("archive targets are not supported in the REPL mode")
+	}
+	return r.p.validateFlags()
+}
+
+func (r *replSession) parseTargets() error {
+	filenames, err := r.p.collectPHPFiles()
+	if err != nil {
+		return err
+	}
+
+	files := make([]parsedFile, len(filenames))
+	var wg sync.WaitGroup
+	wg.Add(r.p.args.workers)
+	for i := 0; i < r.p.args.workers; i++ {
+		go func(id int) {
+			defer wg.Done()
+			w := &worker{irconv: irconv.NewConverter(phpdoc.NewTypeParser())}
+			for j := id; j < len(filenames); j += r.p.args.workers {
+				filename := filenames[j]
+				data, err := ioutil.ReadFile(filename)
+				if err != nil {
+					log.Printf("error: read %s: %v", filename, err)
+					continue
+				}
+				files[j] = r.parseFile(w, filename, data)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, f := range files {
+		if len(f.roots) != 0 {
+			r.files = append(r.files, f)
+		}
+	}
+	return nil
+}
+
+// parseFile parses the file or its code sections, like the grepData does.
+// The sections that can't be parsed are reported and skipped.
+func (r *replSession) parseFile(w *worker, filename string, data []byte) parsedFile {
+	f := parsedFile{filename: filename, data: data}
+	extract := r.p.sectionExtractors[filepath.Ext(filename)]
+	if extract == nil {
+		root, err := w.parseFile(data)
+		if err != nil {
+			log.Printf("error: parse %s: %v", filename, err)
+			return f
+		}
+		f.roots = append(f.roots, parsedRoot{root: root})
+		return f
+	}
+	sections := extract(data)
+	for i := range sections {
+		section := &sections[i]
+		root, err := w.parseFile(section.code)
+		if err != nil {
+			log.Printf("error: parse %s:%d: %v", filename, section.line, err)
+			continue
+		}
+		f.roots = append(f.roots, parsedRoot{section: section, root: root})
+	}
+	return f
+}
+
+func (r *replSession) loop() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "phpgrep> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(os.Stderr)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line != ":history" && !strings.HasPrefix(line, ":redo") {
+			r.history = append(r.history, line)
+		}
+		if !r.exec(line) {
+			return
+		}
+	}
+}
+
+// exec runs a single REPL input line.
+// It returns false if the REPL session should be terminated.
+func (r *replSession) exec(line string) bool {
+	if !strings.HasPrefix(line, ":") {
+		r.p.args.pattern = line
+		r.run()
+		return true
+	}
+
+	command := line
+	argument := ""
+	if space := strings.IndexByte(line, ' '); space != -1 {
+		command = line[:space]
+		argument = strings.TrimSpace(line[space+1:])
+	}
+
+	switch command {
+	case ":quit", ":q":
+		return false
+	case ":help":
+		fmt.Println(replHelp)
+	case ":filter":
+		if argument == "" {
+			r.p.args.filters = nil
+		} else {
+			r.p.args.filters = append(r.p.args.filters, argument)
+		}
+		r.run()
+	case ":format":
+		if argument == "" {
+			argument = r.defaultFormat
+		}
+		r.p.args.format = argument
+		r.run()
+	case ":show":
+		n, err := strconv.Atoi(argument)
+		if err != nil || n < 0 {
+			log.Printf("error: :show expects a non-negative number, found %q", argument)
+			return true
+		}
+		r.show = n
+	case ":history":
+		for i, s := range r.history {
+			fmt.Printf("%4d  %s\n", i+1, s)
+		}
+	case ":redo":
+		n, err := strconv.Atoi(argument)
+		if err != nil || n < 1 || n > len(r.history) {
+			log.Printf("error: :redo expects a history entry number, found %q", argument)
+			return true
+		}
+		entry := r.history[n-1]
+		r.history = append(r.history, entry)
+		return r.exec(entry)
+	case ":export":
+		switch argument {
+		case "":
+			fmt.Println(r.exportCommandLine())
+		case "rule":
+			entry, err := r.exportRule()
+			if err != nil {
+				log.Printf("error: export rule: %v", err)
+				return true
+			}
+			fmt.Println(entry)
+		default:
+			log.Printf("error: :export expects no argument or \"rule\", found %q", argument)
+		}
+	default:
+		log.Printf("error: unknown command %s, type :help for the list of commands", command)
+	}
+
+	return true
+}
+
+func (r *replSession) run() {
+	p := r.p
+	if p.args.pattern == "" {
+		return
+	}
+
+	p.filters = nil
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{"compile filters", p.compileFilters},
+		{"compile pattern", p.compilePattern},
+		{"compile output format", p.compileOutputFormat},
+		{"load codeowners", r.loadCodeowners},
+	}
+	for _, step := range steps {
+		if err := step.fn(); err != nil {
+			log.Printf("error: %s: %v", step.name, err)
+			return
+		}
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(len(p.workers))
+	for _, w := range p.workers {
+		go func(w *worker) {
+			defer wg.Done()
+			for i := w.id; i < len(r.files); i += len(p.workers) {
+				f := r.files[i]
+				for _, root := range f.roots {
+					w.walkRoot(f.filename, f.data, root.section, root.root)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var matches []match
+	for _, w := range p.workers {
+		matches = append(matches, w.matches...)
+	}
+	sortMatches(matches)
+
+	if err := r.printMatches(matches); err != nil {
+		log.Printf("error: print match: %v", err)
+		return
+	}
+	log.Printf("found %d matches in %s", len(matches), elapsed.Round(time.Millisecond))
+}
+
+// printMatches prints the first :show matches. Like in the CLI mode,
+// only the printed matches are annotated with the blame and owners info.
+func (r *replSession) printMatches(matches []match) error {
+	if len(matches) > r.show {
+		matches = matches[:r.show]
+	}
+	r.p.annotateMatches(matches, "")
+	for _, m := range matches {
+		if err := printMatch(r.p.outputTemplate, &r.p.args, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCodeowners loads the CODEOWNERS file once the format needs it,
+// since the format can be changed with the :format command.
+func (r *replSession) loadCodeowners() error {
+	if r.p.owners != nil {
+		return nil
+	}
+	return r.p.loadCodeowners()
+}
+
+// exportedFlags returns the flags that differ from their default values.
+// The format is the only flag that can be changed in the REPL.
+func (r *replSession) exportedFlags() []string {
+	var current arguments
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	bindFlags(fs, &current)
+	// The flag values point to the current fields.
+	current = r.args
+	current.format = r.p.args.format
+
+	var flags []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() == f.DefValue {
+			return
+		}
+		name := "--" + f.Name
+		if len(f.Name) == 1 {
+			name = "-" + f.Name
+		}
+		if list, ok := f.Value.(*stringList); ok {
+			for _, s := range *list {
+				flags = append(flags, name, s)
+			}
+			return
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			if f.Value.String() == "true" {
+				flags = append(flags, name)
+			} else {
+				flags = append(flags, name+"="+f.Value.String())
+			}
+			return
+		}
+		flags = append(flags, name, f.Value.String())
+	})
+	return flags
+}
+
+func (r *replSession) exportCommandLine() string {
+	args := &r.p.args
+	parts := []string{"phpgrep"}
+	for _, s := range r.exportedFlags() {
+		if strings.HasPrefix(s, "-") {
+			parts = append(parts, s)
+		} else {
+			parts = append(parts, shellQuote(s))
+		}
+	}
+	parts = append(parts, shellQuote(args.targets), shellQuote(args.pattern))
+	for _, f := range args.filters {
+		parts = append(parts, shellQuote(f))
+	}
+	return strings.Join(parts, " ")
+}
+
+// replRule is a JSON rule entry, it describes the search without the targets.
+type replRule struct {
+	Pattern string   `json:"pattern"`
+	Filters []string `json:"filters,omitempty"`
+	Flags   []string `json:"flags,omitempty"`
+}
+
+func (r *replSession) exportRule() (string, error) {
+	rule := replRule{
+		Pattern: r.p.args.pattern,
+		Filters: r.p.args.filters,
+		Flags:   r.exportedFlags(),
+	}
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
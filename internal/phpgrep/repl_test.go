@@ -0,0 +1,251 @@
+package phpgrep
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/VKCOM/noverify/src/ir/irconv"
+	"github.com/VKCOM/noverify/src/phpdoc"
+	"github.com/google/go-cmp/cmp"
+)
+
+func newReplTestSession(t *testing.T, argv ...string) *replSession {
+	var args arguments
+	fs := flag.NewFlagSet("phpgrep repl", flag.ContinueOnError)
+	bindFlags(fs, &args)
+	if err := fs.Parse(argv); err != nil {
+		t.Fatal(err)
+	}
+	args.targets = fs.Arg(0)
+	return newReplSession(args)
+}
+
+func TestReplExec(t *testing.T) {
+	r := newReplTestSession(t, "src/")
+	r.history = []string{":show 3"}
+
+	tests := []struct {
+		line    string
+		more    bool
+		show    int
+		filters []string
+		format  string
+	}{
+		{line: ":show 5", more: true, show: 5},
+		{line: ":show -1", more: true, show: 5},
+		{line: ":show x", more: true, show: 5},
+		{line: ":filter x=1", more: true, show: 5, filters: []string{"x=1"}},
+		{line: ":filter  y~^a ", more: true, show: 5, filters: []string{"x=1", "y~^a"}},
+		{line: ":format {{.Match}}", more: true, show: 5, filters: []string{"x=1", "y~^a"}, format: "{{.Match}}"},
+		{line: ":filter", more: true, show: 5, format: "{{.Match}}"},
+		{line: ":format", more: true, show: 5},
+		{line: ":redo 1", more: true, show: 3},
+		{line: ":redo 10", more: true, show: 3},
+		{line: ":unknown", more: true, show: 3},
+		{line: ":quit", more: false, show: 3},
+		{line: ":q", more: false, show: 3},
+	}
+
+	for _, test := range tests {
+		if have := r.exec(test.line); have != test.more {
+			t.Errorf("exec(%q): have %v, want %v", test.line, have, test.more)
+		}
+		if r.show != test.show {
+			t.Errorf("exec(%q): have show=%d, want %d", test.line, r.show, test.show)
+		}
+		if diff := cmp.Diff(test.filters, r.p.args.filters); diff != "" {
+			t.Errorf("exec(%q): filters mismatch (-want +have):\n%s", test.line, diff)
+		}
+		wantFormat := test.format
+		if wantFormat == "" {
+			wantFormat = defaultFormat
+		}
+		if r.p.args.format != wantFormat {
+			t.Errorf("exec(%q): have format %q, want %q", test.line, r.p.args.format, wantFormat)
+		}
+	}
+
+	wantHistory := []string{":show 3", ":show 3"}
+	if diff := cmp.Diff(wantHistory, r.history); diff != "" {
+		t.Errorf("history mismatch (-want +have):\n%s", diff)
+	}
+}
+
+func TestReplExport(t *testing.T) {
+	tests := []struct {
+		argv     []string
+		format   string
+		pattern  string
+		filters  []string
+		command  string
+		rule     string
+		validate bool
+	}{
+		{
+			argv:    []string{"src/"},
+			pattern: "f($x)",
+			command: `phpgrep 'src/' 'f($x)'`,
+			rule:    `{"pattern":"f($x)"}`,
+		},
+		{
+			// The validation sets the default --limit and --workers, they're not exported.
+			argv:     []string{"--strict-syntax", "src/"},
+			pattern:  "f($x)",
+			command:  `phpgrep --strict-syntax 'src/' 'f($x)'`,
+			rule:     `{"pattern":"f($x)","flags":["--strict-syntax"]}`,
+			validate: true,
+		},
+		{
+			argv: []string{
+				"--exclude-results", "baseline.txt",
+				"--no-ignore",
+				"--limit", "10",
+				"--exclude", "glob:vendor/",
+				"--exclude", `re:\.tpl$`,
+				"-m",
+				"src/,lib/",
+			},
+			format:  "{{.x}}",
+			pattern: "f($x)",
+			filters: []string{"x~'a'"},
+			command: `phpgrep --exclude 'glob:vendor/' --exclude 're:\.tpl$' --exclude-results 'baseline.txt' --format '{{.x}}' --limit '10' -m --no-ignore 'src/,lib/' 'f($x)' 'x~'\''a'\'''`,
+			rule:    `{"pattern":"f($x)","filters":["x~'a'"],"flags":["--exclude","glob:vendor/","--exclude","re:\\.tpl$","--exclude-results","baseline.txt","--format","{{.x}}","--limit","10","-m","--no-ignore"]}`,
+		},
+	}
+
+	for _, test := range tests {
+		r := newReplTestSession(t, test.argv...)
+		if test.validate {
+			if err := r.validateFlags(); err != nil {
+				t.Fatalf("%q: validate: %v", test.argv, err)
+			}
+		}
+		if test.format != "" {
+			r.exec(":format " + test.format)
+		}
+		for _, f := range test.filters {
+			r.exec(":filter " + f)
+		}
+		r.p.args.pattern = test.pattern
+
+		if have := r.exportCommandLine(); have != test.command {
+			t.Errorf("%q: command line mismatch:\nhave: %s\nwant: %s", test.argv, have, test.command)
+		}
+		rule, err := r.exportRule()
+		if err != nil {
+			t.Errorf("%q: export rule: %v", test.argv, err)
+			continue
+		}
+		if rule != test.rule {
+			t.Errorf("%q: rule mismatch:\nhave: %s\nwant: %s", test.argv, rule, test.rule)
+		}
+	}
+}
+
+func TestReplValidateFlags(t *testing.T) {
+	tests := []struct {
+		argv []string
+		ok   bool
+	}{
+		{argv: []string{"src/"}, ok: true},
+		{argv: []string{"-i", "src/"}},
+		{argv: []string{"--markdown", "docs/"}, ok: true},
+		{argv: []string{"-"}},
+		{argv: []string{"src/,vendor.phar"}},
+	}
+	for _, test := range tests {
+		err := newReplTestSession(t, test.argv...).validateFlags()
+		if test.ok && err != nil {
+			t.Errorf("%q: unexpected error: %v", test.argv, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%q: expected an error", test.argv)
+		}
+	}
+}
+
+func TestReplParseSections(t *testing.T) {
+	r := newReplTestSession(t, "tests/")
+	if err := r.validateFlags(); err != nil {
+		t.Fatal(err)
+	}
+	w := &worker{irconv: irconv.NewConverter(phpdoc.NewTypeParser())}
+
+	f := r.parseFile(w, "tests/a.phpt", []byte("--TEST--\nf\n--FILE--\n<?php\nf(1);\n--EXPECT--\nf\n--CLEAN--\n<?php\nf(2);\n"))
+	var lines []int
+	for _, root := range f.roots {
+		if root.section == nil {
+			t.Errorf("tests/a.phpt: the root is not a section")
+			continue
+		}
+		lines = append(lines, root.section.line)
+	}
+	if diff := cmp.Diff([]int{4, 9}, lines); diff != "" {
+		t.Errorf("tests/a.phpt: section lines mismatch (-want +have):\n%s", diff)
+	}
+
+	f = r.parseFile(w, "tests/a.php", []byte("<?php\nf(1);\n"))
+	// The ordinary files are parsed entirely.
+	if len(f.roots) != 1 || f.roots[0].section != nil {
+		t.Errorf("tests/a.php: have %d roots, want 1 without a section", len(f.roots))
+	}
+
+	// Without --markdown, the documents are not searched at all.
+	if _, ok := r.p.sectionExtractors[".md"]; ok {
+		t.Errorf("markdown is parsed without --markdown")
+	}
+	r = newReplTestSession(t, "--markdown", "docs/")
+	if err := r.validateFlags(); err != nil {
+		t.Fatal(err)
+	}
+	f = r.parseFile(w, "docs/README.md", []byte("# Usage\n\n```php\nf(1);\n```\n\n```js\nf(2);\n```\n"))
+	if len(f.roots) != 1 || f.roots[0].section == nil || f.roots[0].section.line != 4 {
+		t.Errorf("docs/README.md: have %d roots, want 1 section at line 4", len(f.roots))
+	}
+}
+
+func TestReplAnnotateMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-repl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	codeowners := filepath.Join(dir, "CODEOWNERS")
+	if err := ioutil.WriteFile(codeowners, []byte("src/ @team\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newReplTestSession(t, "--codeowners", codeowners, "--format", "{{.Owners}} {{.Filename}}", "src/")
+	if err := r.validateFlags(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.p.compileOutputFormat(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.loadCodeowners(); err != nil {
+		t.Fatal(err)
+	}
+	if r.p.owners == nil {
+		t.Fatalf("CODEOWNERS is not loaded")
+	}
+
+	filename := filepath.Join(dir, "src", "a.php")
+	matches := []match{
+		{filename: filename, line: 1, text: "f()", matchLength: 3},
+		{filename: filename, line: 2, text: "f()", matchLength: 3},
+	}
+	r.show = 1
+	if err := r.printMatches(matches); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"@team"}, matches[0].owners); diff != "" {
+		t.Errorf("printed match owners mismatch (-want +have):\n%s", diff)
+	}
+	// Only the printed matches are annotated.
+	if matches[1].owners != nil {
+		t.Errorf("have %v owners for the hidden match", matches[1].owners)
+	}
+}
@@ -0,0 +1,240 @@
+package phpgrep
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/VKCOM/php-parser/pkg/position"
+)
+
+// markdownExtensions are searched with --markdown.
+var markdownExtensions = []string{".md", ".markdown"}
+
+// phptCodeSections are the .phpt test sections that contain PHP code.
+var phptCodeSections = map[string]bool{
+	"FILE":    true,
+	"FILEEOF": true,
+	"SKIPIF":  true,
+	"CLEAN":   true,
+}
+
+// phptSectionRegexp matches the .phpt section header line, like "--FILE--".
+var phptSectionRegexp = regexp.MustCompile(`^--([A-Z_]+)--\r?$`)
+
+// codeSection is a piece of PHP code embedded into a non-PHP file.
+// Every section is parsed separately and the match positions
+// are mapped back to the file.
+type codeSection struct {
+	// code is the parsed source; it starts with a prefix
+	// that is not a part of the file (like the "<?php" tag).
+	code      []byte
+	prefixLen int
+
+	// offset and line are the file position of code[prefixLen].
+	offset int
+	line   int
+}
+
+// sectionExtractor returns the code sections of the file contents.
+type sectionExtractor func(data []byte) []codeSection
+
+// compileSectionExtractors selects the file extensions that are
+// searched by their code sections instead of parsing the entire file.
+func (p *program) compileSectionExtractors() {
+	p.sectionExtractors = map[string]sectionExtractor{
+		// php-src tests are only searched if .phpt is in the --php-ext list.
+		".phpt": extractPHPTSections,
+	}
+	if p.args.markdown {
+		for _, ext := range markdownExtensions {
+			p.sectionExtractors[ext] = extractMarkdownSections
+			p.args.phpFileExtList = append(p.args.phpFileExtList, ext)
+		}
+	}
+}
+
+// fileOffset maps the code offset to the file offset.
+func (s *codeSection) fileOffset(pos int) int {
+	if pos < s.prefixLen {
+		pos = s.prefixLen
+	}
+	return pos - s.prefixLen + s.offset
+}
+
+func (s *codeSection) filePosition(pos *position.Position) *position.Position {
+	return &position.Position{
+		StartLine: pos.StartLine + s.line - 1,
+		EndLine:   pos.EndLine + s.line - 1,
+		StartPos:  s.fileOffset(pos.StartPos),
+		EndPos:    s.fileOffset(pos.EndPos),
+	}
+}
+
+// filePosition maps the position of the currently walked code to the file position.
+func (w *worker) filePosition(pos *position.Position) *position.Position {
+	if w.section == nil {
+		return pos
+	}
+	return w.section.filePosition(pos)
+}
+
+// grepSections parses and greps every file section separately.
+// The sections that can't be parsed are reported as skipped.
+// complete is false if some of the sections were skipped.
+func (w *worker) grepSections(filename string, data []byte, sections []codeSection) (n int, complete bool, err error) {
+	complete = true
+	for i := range sections {
+		section := &sections[i]
+		parseStart := time.Now()
+		root, err := w.parseFileWithTimeout(section.code)
+		w.stats.parseTime += time.Since(parseStart)
+		if err == errFileTimeout {
+			return n, false, err
+		}
+		if err != nil {
+			w.stats.parseFailures++
+			w.skip(fmt.Sprintf("%s:%d", filename, section.line), fmt.Sprintf("code can't be parsed: %v", err))
+			complete = false
+			continue
+		}
+		matchStart := time.Now()
+		n += w.walkRoot(filename, data, section, root)
+		w.stats.matchTime += time.Since(matchStart)
+		if w.timedOut || w.stopped {
+			break
+		}
+	}
+	return n, complete, nil
+}
+
+// extractMarkdownSections returns the fenced ```php code blocks.
+// "<?php" is prepended to the blocks that don't start with an open tag.
+func extractMarkdownSections(data []byte) []codeSection {
+	var sections []codeSection
+
+	var fence string // Opening fence of the current PHP block, if any
+	blockStart := 0
+	blockLine := 0
+	lineNum := 0
+	for offset := 0; offset < len(data); {
+		lineNum++
+		end := bytes.IndexByte(data[offset:], '\n')
+		next := len(data)
+		if end != -1 {
+			next = offset + end + 1
+		}
+		line := strings.TrimRight(string(data[offset:next]), "\r\n")
+		trimmed := strings.TrimLeft(line, " \t")
+
+		switch {
+		case fence != "":
+			if isClosingFence(trimmed, fence) {
+				sections = appendMarkdownSection(sections, data[blockStart:offset], blockStart, blockLine)
+				fence = ""
+			}
+		default:
+			if f, info := parseOpeningFence(trimmed); f != "" {
+				if lang := strings.Fields(info); len(lang) != 0 && strings.EqualFold(lang[0], "php") {
+					fence = f
+					blockStart = next
+					blockLine = lineNum + 1
+				}
+			}
+		}
+		offset = next
+	}
+	// Unclosed block lasts until the end of the document.
+	if fence != "" && blockStart < len(data) {
+		sections = appendMarkdownSection(sections, data[blockStart:], blockStart, blockLine)
+	}
+	return sections
+}
+
+// parseOpeningFence returns the fence (like "```" or "~~~~") and the info string.
+func parseOpeningFence(line string) (fence, info string) {
+	if !strings.HasPrefix(line, "```") && !strings.HasPrefix(line, "~~~") {
+		return "", ""
+	}
+	n := 0
+	for n < len(line) && line[n] == line[0] {
+		n++
+	}
+	info = strings.TrimSpace(line[n:])
+	// Backtick fence info string can't contain backticks.
+	if line[0] == '`' && strings.Contains(info, "`") {
+		return "", ""
+	}
+	return line[:n], info
+}
+
+func isClosingFence(line, fence string) bool {
+	n := 0
+	for n < len(line) && line[n] == fence[0] {
+		n++
+	}
+	return n >= len(fence) && strings.TrimSpace(line[n:]) == ""
+}
+
+func appendMarkdownSection(sections []codeSection, code []byte, offset, line int) []codeSection {
+	trimmed := bytes.TrimLeft(code, " \t\r\n")
+	if len(trimmed) == 0 {
+		return sections
+	}
+	section := codeSection{code: code, offset: offset, line: line}
+	// Blocks that start with "<" are templates or have an open tag already.
+	if trimmed[0] != '<' {
+		const prefix = "<?php "
+		section.code = make([]byte, 0, len(prefix)+len(code))
+		section.code = append(section.code, prefix...)
+		section.code = append(section.code, code...)
+		section.prefixLen = len(prefix)
+	}
+	return append(sections, section)
+}
+
+// extractPHPTSections returns the code sections of the php-src .phpt test file.
+// Unlike the Markdown blocks, the sections are complete PHP files,
+// so nothing is prepended to them.
+func extractPHPTSections(data []byte) []codeSection {
+	var sections []codeSection
+
+	inCode := false
+	sectionStart := 0
+	sectionLine := 0
+	lineNum := 0
+	for offset := 0; offset < len(data); {
+		lineNum++
+		end := bytes.IndexByte(data[offset:], '\n')
+		next := len(data)
+		if end != -1 {
+			next = offset + end
+		}
+		header := phptSectionRegexp.FindSubmatch(data[offset:next])
+		if end != -1 {
+			next++
+		}
+		if header != nil {
+			if inCode {
+				sections = appendPHPTSection(sections, data[sectionStart:offset], sectionStart, sectionLine)
+			}
+			inCode = phptCodeSections[string(header[1])]
+			sectionStart = next
+			sectionLine = lineNum + 1
+		}
+		offset = next
+	}
+	if inCode {
+		sections = appendPHPTSection(sections, data[sectionStart:], sectionStart, sectionLine)
+	}
+	return sections
+}
+
+func appendPHPTSection(sections []codeSection, code []byte, offset, line int) []codeSection {
+	if len(bytes.TrimSpace(code)) == 0 {
+		return sections
+	}
+	return append(sections, codeSection{code: code, offset: offset, line: line})
+}
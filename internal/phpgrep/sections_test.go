@@ -0,0 +1,131 @@
+package phpgrep
+
+import (
+	"testing"
+
+	"github.com/VKCOM/php-parser/pkg/position"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExtractMarkdownSections(t *testing.T) {
+	doc := "# Usage\n" +
+		"\n" +
+		"```php\n" +
+		"$x = f();\n" +
+		"```\n" +
+		"\n" +
+		"```bash\n" +
+		"php -r 'g();'\n" +
+		"```\n" +
+		"\n" +
+		"  ~~~~ PHP title=\"example\"\n" +
+		"<?php\n" +
+		"h();\n" +
+		"  ~~~~\n" +
+		"```php\n" +
+		"```\n" +
+		"````php\n" +
+		"```\n" +
+		"unclosed();\n"
+
+	type sectionInfo struct {
+		Code      string
+		PrefixLen int
+		Offset    int
+		Line      int
+	}
+	var have []sectionInfo
+	for _, s := range extractMarkdownSections([]byte(doc)) {
+		have = append(have, sectionInfo{string(s.code), s.prefixLen, s.offset, s.line})
+		if string(s.code[s.prefixLen:]) != doc[s.offset:s.offset+len(s.code)-s.prefixLen] {
+			t.Errorf("section at line %d doesn't match the document contents", s.line)
+		}
+	}
+	want := []sectionInfo{
+		{Code: "<?php $x = f();\n", PrefixLen: 6, Offset: 16, Line: 4},
+		{Code: "<?php\nh();\n", PrefixLen: 0, Offset: 85, Line: 12},
+		{Code: "<?php ```\nunclosed();\n", PrefixLen: 6, Offset: 122, Line: 18},
+	}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("sections mismatch (-want +have):\n%s", diff)
+	}
+}
+
+func TestCodeSectionFilePosition(t *testing.T) {
+	s := codeSection{prefixLen: 6, offset: 100, line: 10}
+	have := s.filePosition(&position.Position{StartLine: 1, EndLine: 2, StartPos: 6, EndPos: 20})
+	want := &position.Position{StartLine: 10, EndLine: 11, StartPos: 100, EndPos: 114}
+	if *have != *want {
+		t.Errorf("filePosition: have %+v, want %+v", *have, *want)
+	}
+}
+
+func TestExtractPHPTSections(t *testing.T) {
+	test := "--TEST--\n" +
+		"strlen() basic\n" +
+		"--SKIPIF--\n" +
+		"<?php if (PHP_INT_SIZE != 8) die('skip'); ?>\n" +
+		"--FILE--\r\n" +
+		"<?php\r\n" +
+		"var_dump(strlen('abc'));\r\n" +
+		"?>\r\n" +
+		"--EXPECT--\n" +
+		"int(3)\n" +
+		"--CLEAN--\n" +
+		"<?php @unlink('--FILE--'); ?>\n" +
+		"--EXTENSIONS--\n" +
+		"\n"
+
+	type sectionInfo struct {
+		Code string
+		Line int
+	}
+	var have []sectionInfo
+	for _, s := range extractPHPTSections([]byte(test)) {
+		have = append(have, sectionInfo{string(s.code), s.line})
+		if s.prefixLen != 0 || string(s.code) != test[s.offset:s.offset+len(s.code)] {
+			t.Errorf("section at line %d doesn't match the file contents", s.line)
+		}
+	}
+	want := []sectionInfo{
+		{Code: "<?php if (PHP_INT_SIZE != 8) die('skip'); ?>\n", Line: 4},
+		{Code: "<?php\r\nvar_dump(strlen('abc'));\r\n?>\r\n", Line: 6},
+		{Code: "<?php @unlink('--FILE--'); ?>\n", Line: 12},
+	}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("sections mismatch (-want +have):\n%s", diff)
+	}
+}
+
+func TestPHPTOptIn(t *testing.T) {
+	tests := []struct {
+		phpFileExt string
+		searched   bool
+	}{
+		// The .phpt files are not searched unless they're requested.
+		{phpFileExt: defaultPHPFileExt, searched: false},
+		{phpFileExt: defaultPHPFileExt + ",phpt", searched: true},
+	}
+	for _, test := range tests {
+		p := &program{
+			args: arguments{
+				targets:      "tests",
+				pattern:      "f($x)",
+				format:       defaultFormat,
+				phpFileExt:   test.phpFileExt,
+				workers:      1,
+				sort:         "path",
+				progressMode: "none",
+			},
+		}
+		if err := p.validateFlags(); err != nil {
+			t.Fatal(err)
+		}
+		if have := p.isPHPFile("strlen.phpt"); have != test.searched {
+			t.Errorf("--php-ext %s: have searched=%v, want %v", test.phpFileExt, have, test.searched)
+		}
+		if p.sectionExtractors[".phpt"] == nil {
+			t.Errorf("--php-ext %s: .phpt files are parsed entirely", test.phpFileExt)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package phpgrep
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseShard parses the --shard "K/N" value.
+// K is 1-based, so the valid shards for N=3 are 1/3, 2/3 and 3/3.
+func parseShard(s string) (index, count int, err error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected K/N format, found %q", s)
+	}
+	index, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse K: %v", err)
+	}
+	count, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse N: %v", err)
+	}
+	if count < 1 {
+		return 0, 0, fmt.Errorf("N can't be less than 1")
+	}
+	if index < 1 || index > count {
+		return 0, 0, fmt.Errorf("K should be in [1, %d] range", count)
+	}
+	return index, count, nil
+}
+
+// inShard reports whether the file belongs to the current --shard.
+// rel is the file path relative to the target root.
+//
+// The partitioning depends only on the relative path, so every file
+// is assigned to the same shard by all phpgrep runs, even if the target
+// is spelled differently (like "src", "./src" or an absolute path).
+func (p *program) inShard(rel string) bool {
+	if p.shardCount <= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(filepath.ToSlash(filepath.Clean(rel))))
+	return int(h.Sum64()%uint64(p.shardCount)) == p.shardIndex-1
+}
+
+func mergeMain(argv []string) (int, error) {
+	fs := flag.NewFlagSet("phpgrep merge", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), `Usage: phpgrep merge report.json...
+
+Combines the --json reports produced by the --shard runs into one report.
+`)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return exitError, err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitError, fmt.Errorf("expected at least 1 report file")
+	}
+
+	merged := jsonReport{Matches: []jsonMatch{}}
+	ownerCounts := make(map[string]int)
+	shardCount := 0
+	seenShards := make(map[string]bool)
+	for _, filename := range fs.Args() {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return exitError, err
+		}
+		var report jsonReport
+		if err := json.Unmarshal(data, &report); err != nil {
+			return exitError, fmt.Errorf("decode %s: %v", filename, err)
+		}
+		if report.StoppedEarly {
+			// Its found count is only a lower bound.
+			return exitError, fmt.Errorf("%s: the search was stopped early by the --limit, the totals would be incorrect", filename)
+		}
+
+		for _, shard := range report.Shards {
+			if seenShards[shard] {
+				return exitError, fmt.Errorf("%s: shard %s is already merged", filename, shard)
+			}
+			seenShards[shard] = true
+			_, count, err := parseShard(shard)
+			if err != nil {
+				return exitError, fmt.Errorf("%s: shard %s: %v", filename, shard, err)
+			}
+			if shardCount != 0 && shardCount != count {
+				return exitError, fmt.Errorf("%s: shard %s count doesn't match other reports N=%d", filename, shard, shardCount)
+			}
+			shardCount = count
+			merged.Shards = append(merged.Shards, shard)
+		}
+
+		merged.Matches = append(merged.Matches, report.Matches...)
+		merged.Skipped = append(merged.Skipped, report.Skipped...)
+		for _, c := range report.OwnerCounts {
+			ownerCounts[c.Owner] += c.Matches
+		}
+		merged.Found += report.Found
+		merged.Truncated = merged.Truncated || report.Truncated
+	}
+
+	if shardCount != 0 && len(merged.Shards) != shardCount {
+		log.Printf("warning: merged %d of %d shards", len(merged.Shards), shardCount)
+	}
+	sort.Strings(merged.Shards)
+	for owner, count := range ownerCounts {
+		merged.OwnerCounts = append(merged.OwnerCounts, jsonOwnerCount{Owner: owner, Matches: count})
+	}
+	sort.Slice(merged.OwnerCounts, func(i, j int) bool {
+		x := merged.OwnerCounts[i]
+		y := merged.OwnerCounts[j]
+		if x.Matches != y.Matches {
+			return x.Matches > y.Matches
+		}
+		return x.Owner < y.Owner
+	})
+	sort.SliceStable(merged.Matches, func(i, j int) bool {
+		x := merged.Matches[i]
+		y := merged.Matches[j]
+		if x.Filename != y.Filename {
+			return x.Filename < y.Filename
+		}
+		return x.StartPos < y.StartPos
+	})
+	sort.SliceStable(merged.Skipped, func(i, j int) bool {
+		return merged.Skipped[i].Filename < merged.Skipped[j].Filename
+	})
+
+	if err := writeJSONReport(merged); err != nil {
+		return exitError, err
+	}
+	if merged.Found == 0 {
+		return exitNotMatched, nil
+	}
+	return exitMatched, nil
+}
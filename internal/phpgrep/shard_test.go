@@ -0,0 +1,152 @@
+package phpgrep
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		s     string
+		index int
+		count int
+		err   string
+	}{
+		{s: "1/1", index: 1, count: 1},
+		{s: "2/4", index: 2, count: 4},
+		{s: "4/4", index: 4, count: 4},
+		{s: "0/4", err: "K should be in [1, 4] range"},
+		{s: "5/4", err: "K should be in [1, 4] range"},
+		{s: "1/0", err: "N can't be less than 1"},
+		{s: "1", err: `expected K/N format, found "1"`},
+		{s: "x/2", err: `parse K: strconv.Atoi: parsing "x": invalid syntax`},
+	}
+
+	for _, test := range tests {
+		index, count, err := parseShard(test.s)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("parseShard(%q): error mismatch: have %v, want %s", test.s, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseShard(%q): unexpected error: %v", test.s, err)
+			continue
+		}
+		if index != test.index || count != test.count {
+			t.Errorf("parseShard(%q): have %d/%d, want %d/%d", test.s, index, count, test.index, test.count)
+		}
+	}
+}
+
+func TestInShard(t *testing.T) {
+	const numShards = 3
+	for i := 0; i < 100; i++ {
+		filename := fmt.Sprintf("src/dir%d/file.php", i)
+		numOwners := 0
+		for k := 1; k <= numShards; k++ {
+			p := &program{shardIndex: k, shardCount: numShards}
+			if p.inShard(filename) {
+				numOwners++
+			}
+		}
+		if numOwners != 1 {
+			t.Errorf("%s belongs to %d shards", filename, numOwners)
+		}
+	}
+}
+
+func TestShardTargetSpelling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 20; i++ {
+		filename := filepath.Join(dir, "src", fmt.Sprintf("dir%d", i%3), fmt.Sprintf("f%d.php", i))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte("<?php\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// shardFiles returns the shard files relative to the target.
+	shardFiles := func(target string, shard int) []string {
+		p := &program{
+			args: arguments{
+				targets:        target,
+				workers:        2,
+				phpFileExtList: []string{".php"},
+			},
+			shardIndex: shard,
+			shardCount: 2,
+		}
+		filenames, err := p.collectPHPFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rel []string
+		for _, filename := range filenames {
+			r, err := filepath.Rel(target, filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rel = append(rel, filepath.ToSlash(r))
+		}
+		return rel
+	}
+
+	for shard := 1; shard <= 2; shard++ {
+		want := shardFiles("src", shard)
+		if len(want) == 0 || len(want) == 20 {
+			t.Fatalf("shard %d/2 has %d of 20 files", shard, len(want))
+		}
+		for _, target := range []string{"./src", filepath.Join(dir, "src")} {
+			if diff := cmp.Diff(want, shardFiles(target, shard)); diff != "" {
+				t.Errorf("%s shard %d/2 mismatch (-want +have):\n%s", target, shard, diff)
+			}
+		}
+	}
+}
+
+func TestMergeStoppedEarly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reports := map[string]string{
+		"1.json": `{"matches": [], "found": 3, "truncated": false, "shards": ["1/2"]}`,
+		"2.json": `{"matches": [], "found": 1000, "truncated": true, "stopped_early": true, "shards": ["2/2"]}`,
+	}
+	var filenames []string
+	for name, data := range reports {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+	_, err = mergeMain(filenames)
+	if err == nil || !strings.Contains(err.Error(), "stopped early") {
+		t.Errorf("have %v error, want the stopped early report error", err)
+	}
+}
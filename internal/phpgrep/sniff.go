@@ -0,0 +1,90 @@
+package phpgrep
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// sniffSize is the number of bytes inspected by the --sniff-php.
+// It's enough for any sensible shebang line.
+const sniffSize = 256
+
+// phpInterpreterRegexp matches the shebang interpreter names like "php" or "php8.1".
+var phpInterpreterRegexp = regexp.MustCompile(`^php(?:-cli|-cgi)?[0-9.]*$`)
+
+// isSearchedFile reports whether the file should be searched:
+// it either has one of the --php-ext extensions or
+// it's an extensionless PHP script detected by the --sniff-php.
+func (p *program) isSearchedFile(path, name string) bool {
+	if p.isPHPFile(name) {
+		return true
+	}
+	if !p.args.sniffPHP || filepath.Ext(name) != "" {
+		return false
+	}
+	return sniffPHPFile(path)
+}
+
+func sniffPHPFile(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		// The read error will be reported by the reader if the file is sent.
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, sniffSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false
+	}
+	return isPHPHeader(buf[:n])
+}
+
+// isPHPHeader reports whether the file beginning looks like a PHP script:
+// it starts with "<?php" or with a shebang line that runs php.
+func isPHPHeader(head []byte) bool {
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")) // UTF-8 BOM
+	if hasPHPOpenTag(head) {
+		return true
+	}
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return false
+	}
+
+	line := head[len("#!"):]
+	if i := bytes.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	interpreter := filepath.Base(string(fields[0]))
+	if interpreter == "env" {
+		// "#!/usr/bin/env -S php -d display_errors=1".
+		interpreter = ""
+		for _, arg := range fields[1:] {
+			if !bytes.HasPrefix(arg, []byte("-")) {
+				interpreter = filepath.Base(string(arg))
+				break
+			}
+		}
+	}
+	return phpInterpreterRegexp.MatchString(interpreter)
+}
+
+func hasPHPOpenTag(head []byte) bool {
+	const tag = "<?php"
+	if len(head) < len(tag) || !bytes.EqualFold(head[:len(tag)], []byte(tag)) {
+		return false
+	}
+	// "<?phpinfo" is not an open tag.
+	return len(head) == len(tag) || isSpaceByte(head[len(tag)])
+}
+
+func isSpaceByte(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
@@ -0,0 +1,36 @@
+package phpgrep
+
+import (
+	"testing"
+)
+
+func TestIsPHPHeader(t *testing.T) {
+	tests := []struct {
+		head string
+		want bool
+	}{
+		{"<?php\necho 1;", true},
+		{"<?PHP echo 1;", true},
+		{"\xef\xbb\xbf<?php\n", true},
+		{"<?php", true},
+		{"#!/usr/bin/php\n<?php\n", true},
+		{"#!/usr/bin/env php\n<?php\n", true},
+		{"#!/usr/bin/env -S php -d memory_limit=-1\n", true},
+		{"#!/usr/local/bin/php8.1 -q\n", true},
+		{"#!/usr/bin/php-cli\r\n", true},
+
+		{"", false},
+		{"<?phpinfo", false},
+		{"<?= 1 ?>", false},
+		{"#!/bin/sh\nexec php \"$0\"\n", false},
+		{"#!/usr/bin/env python3\n", false},
+		{"#!/usr/bin/env phpunit\n", false},
+		{"#!\n", false},
+		{"<html><?php echo 1; ?>", false},
+	}
+	for _, test := range tests {
+		if have := isPHPHeader([]byte(test.head)); have != test.want {
+			t.Errorf("isPHPHeader(%q): have %v, want %v", test.head, have, test.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package phpgrep
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// numSlowestFiles is the number of the slowest files reported by --stats.
+const numSlowestFiles = 10
+
+// searchStats is collected during the search if --stats is set.
+// All counters are updated atomically.
+type searchStats struct {
+	filesWalked      int64
+	skippedExtension int64
+	skippedExclude   int64
+	skippedIgnore    int64
+	skippedShard     int64
+	bytesRead        int64
+	startTime        time.Time
+}
+
+// workerStats is a per-worker part of the search stats,
+// so workers don't need to synchronize to update it.
+type workerStats struct {
+	filesGrepped     int
+	skippedPrefilter int
+	skippedSize      int
+	skippedGenerated int
+	timeouts         int
+	cacheHits        int
+	parseFailures    int
+	parseTime        time.Duration
+	matchTime        time.Duration
+
+	// slowest is sorted by the duration in descending order.
+	slowest []fileTiming
+}
+
+type fileTiming struct {
+	filename string
+	duration time.Duration
+}
+
+func (s *workerStats) addTiming(filename string, d time.Duration) {
+	if len(s.slowest) == numSlowestFiles && s.slowest[len(s.slowest)-1].duration >= d {
+		return
+	}
+	s.slowest = append(s.slowest, fileTiming{filename: filename, duration: d})
+	sort.SliceStable(s.slowest, func(i, j int) bool {
+		return s.slowest[i].duration > s.slowest[j].duration
+	})
+	if len(s.slowest) > numSlowestFiles {
+		s.slowest = s.slowest[:numSlowestFiles]
+	}
+}
+
+func (s *searchStats) countWalked() {
+	if s != nil {
+		atomic.AddInt64(&s.filesWalked, 1)
+	}
+}
+
+func (s *searchStats) countSkippedExtension() {
+	if s != nil {
+		atomic.AddInt64(&s.skippedExtension, 1)
+	}
+}
+
+func (s *searchStats) countSkippedExclude() {
+	if s != nil {
+		atomic.AddInt64(&s.skippedExclude, 1)
+	}
+}
+
+func (s *searchStats) countSkippedIgnore() {
+	if s != nil {
+		atomic.AddInt64(&s.skippedIgnore, 1)
+	}
+}
+
+func (s *searchStats) countSkippedShard() {
+	if s != nil {
+		atomic.AddInt64(&s.skippedShard, 1)
+	}
+}
+
+func (s *searchStats) countBytesRead(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.bytesRead, int64(n))
+	}
+}
+
+type statsReport struct {
+	Elapsed          float64           `json:"elapsed_ms"`
+	FilesWalked      int64             `json:"files_walked"`
+	SkippedExtension int64             `json:"skipped_by_extension"`
+	SkippedExclude   int64             `json:"skipped_by_exclude"`
+	SkippedIgnore    int64             `json:"skipped_by_ignore"`
+	SkippedShard     int64             `json:"skipped_by_shard"`
+	SkippedPrefilter int               `json:"skipped_by_prefilter"`
+	SkippedSize      int               `json:"skipped_by_size"`
+	SkippedGenerated int               `json:"skipped_as_generated"`
+	Timeouts         int               `json:"skipped_by_timeout"`
+	FilesGrepped     int               `json:"files_grepped"`
+	CacheHits        int               `json:"cache_hits"`
+	BytesRead        int64             `json:"bytes_read"`
+	ParseTime        float64           `json:"parse_time_ms"`
+	MatchTime        float64           `json:"match_time_ms"`
+	ParseFailures    int               `json:"parse_failures"`
+	Patterns         []patternStats    `json:"patterns"`
+	SlowestFiles     []fileTimingStats `json:"slowest_files"`
+}
+
+type patternStats struct {
+	Pattern string `json:"pattern"`
+	Matches int64  `json:"matches"`
+}
+
+type fileTimingStats struct {
+	Filename string  `json:"filename"`
+	Time     float64 `json:"time_ms"`
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (p *program) printStats() error {
+	if p.stats == nil {
+		return nil
+	}
+	s, err := p.collectStats().format(p.args.statsFormat)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stderr, s)
+	return nil
+}
+
+// collectStats merges the search and all workers stats.
+func (p *program) collectStats() statsReport {
+	r := statsReport{
+		Elapsed:          durationMillis(time.Since(p.stats.startTime)),
+		FilesWalked:      p.stats.filesWalked,
+		SkippedExtension: p.stats.skippedExtension,
+		SkippedExclude:   p.stats.skippedExclude,
+		SkippedIgnore:    p.stats.skippedIgnore,
+		SkippedShard:     p.stats.skippedShard,
+		BytesRead:        p.stats.bytesRead,
+		Patterns: []patternStats{
+			{Pattern: p.args.pattern, Matches: p.matches},
+		},
+		SlowestFiles: []fileTimingStats{},
+	}
+	var parseTime time.Duration
+	var matchTime time.Duration
+	var slowest workerStats
+	for _, w := range p.workers {
+		r.FilesGrepped += w.stats.filesGrepped
+		r.SkippedPrefilter += w.stats.skippedPrefilter
+		r.SkippedSize += w.stats.skippedSize
+		r.SkippedGenerated += w.stats.skippedGenerated
+		r.Timeouts += w.stats.timeouts
+		r.CacheHits += w.stats.cacheHits
+		r.ParseFailures += w.stats.parseFailures
+		parseTime += w.stats.parseTime
+		matchTime += w.stats.matchTime
+		for _, timing := range w.stats.slowest {
+			slowest.addTiming(timing.filename, timing.duration)
+		}
+	}
+	r.ParseTime = durationMillis(parseTime)
+	r.MatchTime = durationMillis(matchTime)
+	for _, timing := range slowest.slowest {
+		r.SlowestFiles = append(r.SlowestFiles, fileTimingStats{
+			Filename: timing.filename,
+			Time:     durationMillis(timing.duration),
+		})
+	}
+	return r
+}
+
+// format returns the report in the --stats-format.
+func (r statsReport) format(statsFormat string) (string, error) {
+	if statsFormat == "json" {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data) + "\n", nil
+	}
+
+	var buf strings.Builder
+	buf.WriteString("stats:\n")
+	fmt.Fprintf(&buf, "  elapsed:              %.1fms\n", r.Elapsed)
+	fmt.Fprintf(&buf, "  files walked:         %d\n", r.FilesWalked)
+	fmt.Fprintf(&buf, "  skipped by extension: %d\n", r.SkippedExtension)
+	fmt.Fprintf(&buf, "  skipped by exclude:   %d\n", r.SkippedExclude)
+	fmt.Fprintf(&buf, "  skipped by ignore:    %d\n", r.SkippedIgnore)
+	fmt.Fprintf(&buf, "  skipped by shard:     %d\n", r.SkippedShard)
+	fmt.Fprintf(&buf, "  skipped by prefilter: %d\n", r.SkippedPrefilter)
+	fmt.Fprintf(&buf, "  skipped by size:      %d\n", r.SkippedSize)
+	fmt.Fprintf(&buf, "  skipped by timeout:   %d\n", r.Timeouts)
+	fmt.Fprintf(&buf, "  skipped as generated: %d\n", r.SkippedGenerated)
+	fmt.Fprintf(&buf, "  files grepped:        %d\n", r.FilesGrepped)
+	fmt.Fprintf(&buf, "  cache hits:           %d\n", r.CacheHits)
+	fmt.Fprintf(&buf, "  bytes read:           %d\n", r.BytesRead)
+	fmt.Fprintf(&buf, "  parse time:           %.1fms\n", r.ParseTime)
+	fmt.Fprintf(&buf, "  match time:           %.1fms\n", r.MatchTime)
+	fmt.Fprintf(&buf, "  parse failures:       %d\n", r.ParseFailures)
+	buf.WriteString("  matches per pattern:\n")
+	for _, ps := range r.Patterns {
+		fmt.Fprintf(&buf, "    %d\t%s\n", ps.Matches, ps.Pattern)
+	}
+	buf.WriteString("  slowest files:\n")
+	for _, timing := range r.SlowestFiles {
+		fmt.Fprintf(&buf, "    %.1fms\t%s\n", timing.Time, timing.Filename)
+	}
+	return buf.String(), nil
+}
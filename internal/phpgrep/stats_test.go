@@ -0,0 +1,156 @@
+package phpgrep
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStatsCounters(t *testing.T) {
+	s := &searchStats{}
+	for i := 0; i < 5; i++ {
+		s.countWalked()
+	}
+	s.countSkippedExtension()
+	s.countSkippedExclude()
+	s.countSkippedExclude()
+	s.countSkippedIgnore()
+	s.countSkippedShard()
+	s.countBytesRead(100)
+	s.countBytesRead(20)
+
+	want := searchStats{
+		filesWalked:      5,
+		skippedExtension: 1,
+		skippedExclude:   2,
+		skippedIgnore:    1,
+		skippedShard:     1,
+		bytesRead:        120,
+	}
+	if diff := cmp.Diff(want, *s, cmp.AllowUnexported(searchStats{})); diff != "" {
+		t.Errorf("counters mismatch (-want +have):\n%s", diff)
+	}
+
+	// Without --stats, the counters are not collected.
+	var disabled *searchStats
+	disabled.countWalked()
+	disabled.countSkippedExtension()
+	disabled.countSkippedExclude()
+	disabled.countSkippedIgnore()
+	disabled.countSkippedShard()
+	disabled.countBytesRead(1)
+}
+
+func TestStatsSlowestFiles(t *testing.T) {
+	var s workerStats
+	for i := 1; i <= numSlowestFiles+5; i++ {
+		s.addTiming(fmt.Sprintf("%d.php", i), time.Duration(i%7)*time.Millisecond+time.Duration(i))
+	}
+	var have []string
+	for _, timing := range s.slowest {
+		have = append(have, timing.filename)
+	}
+	want := []string{"13.php", "6.php", "12.php", "5.php", "11.php", "4.php", "10.php", "3.php", "9.php", "2.php"}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("slowest files mismatch (-want +have):\n%s", diff)
+	}
+}
+
+func newStatsTestProgram() *program {
+	p := &program{
+		args:    arguments{pattern: "f($x)"},
+		stats:   &searchStats{filesWalked: 10, skippedExtension: 2, skippedExclude: 1, skippedIgnore: 3, bytesRead: 2048},
+		matches: 4,
+	}
+	w1 := &worker{}
+	w1.stats = workerStats{
+		filesGrepped:     3,
+		skippedPrefilter: 1,
+		skippedGenerated: 1,
+		cacheHits:        1,
+		parseTime:        1500 * time.Microsecond,
+		matchTime:        500 * time.Microsecond,
+	}
+	w1.stats.addTiming("a.php", 2*time.Millisecond)
+	w2 := &worker{}
+	w2.stats = workerStats{
+		filesGrepped:  1,
+		skippedSize:   1,
+		timeouts:      1,
+		parseFailures: 1,
+		parseTime:     time.Millisecond,
+	}
+	w2.stats.addTiming("b.php", time.Millisecond)
+	w2.stats.addTiming("c.php", 3*time.Millisecond)
+	p.workers = []*worker{w1, w2}
+	return p
+}
+
+func TestStatsText(t *testing.T) {
+	r := newStatsTestProgram().collectStats()
+	r.Elapsed = 12.25
+	have, err := r.format("text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `stats:
+  elapsed:              12.2ms
+  files walked:         10
+  skipped by extension: 2
+  skipped by exclude:   1
+  skipped by ignore:    3
+  skipped by shard:     0
+  skipped by prefilter: 1
+  skipped by size:      1
+  skipped by timeout:   1
+  skipped as generated: 1
+  files grepped:        4
+  cache hits:           1
+  bytes read:           2048
+  parse time:           2.5ms
+  match time:           0.5ms
+  parse failures:       1
+  matches per pattern:
+    4	f($x)
+  slowest files:
+    3.0ms	c.php
+    2.0ms	a.php
+    1.0ms	b.php
+`
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("text stats mismatch (-want +have):\n%s", diff)
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+	r := newStatsTestProgram().collectStats()
+	r.Elapsed = 12.25
+	data, err := r.format("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have statsReport
+	if err := json.Unmarshal([]byte(data), &have); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(r, have); diff != "" {
+		t.Errorf("JSON stats mismatch (-want +have):\n%s", diff)
+	}
+
+	// The empty lists are still present in the report.
+	empty := (&program{stats: &searchStats{}}).collectStats()
+	data, err = empty.format("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["slowest_files"].([]interface{}); !ok {
+		t.Errorf("slowest_files is %v, want an empty list", fields["slowest_files"])
+	}
+}
@@ -0,0 +1,64 @@
+package phpgrep
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// stdinTarget is a special target name that makes phpgrep read the code from stdin.
+const stdinTarget = "-"
+
+func countStdinTargets(targets string) int {
+	n := 0
+	for _, target := range strings.Split(targets, ",") {
+		if strings.TrimSpace(target) == stdinTarget {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *program) validateStdinTarget() error {
+	n := countStdinTargets(p.args.targets)
+	if n == 0 {
+		return nil
+	}
+	if n > 1 {
+		return fmt.Errorf("stdin target can't be specified more than once")
+	}
+	if p.args.diffBase != "" || p.args.diffFile != "" {
+		return fmt.Errorf("stdin target can't be combined with --diff-base or --diff-file")
+	}
+	// These modes need to re-read or modify the files.
+	if p.args.replace || p.args.watch || p.args.tui {
+		return fmt.Errorf("stdin target can't be combined with -i, --watch or --tui")
+	}
+	// Stdin can't be read again, so it can't be resumed.
+	if p.args.checkpoint != "" {
+		return fmt.Errorf("stdin target can't be combined with --checkpoint")
+	}
+	return nil
+}
+
+// readFileContents reads the file that was sent by the walker.
+// The files larger than --max-file-size are not read.
+func (p *program) readFileContents(filename string) (fileContents, error) {
+	if filename == stdinTarget {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fileContents{}, err
+		}
+		return fileContents{filename: p.args.stdinFilename, data: data}, nil
+	}
+
+	data, size, err := readFileLimited(filename, p.maxFileSize)
+	if err != nil {
+		return fileContents{}, err
+	}
+	if data == nil && size != 0 {
+		return fileContents{filename: filename, tooLarge: true, size: size}, nil
+	}
+	return fileContents{filename: filename, data: data}, nil
+}
@@ -0,0 +1,103 @@
+package phpgrep
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidateStdinTarget(t *testing.T) {
+	tests := []struct {
+		args arguments
+		ok   bool
+	}{
+		{args: arguments{targets: "-"}, ok: true},
+		{args: arguments{targets: "src, -"}, ok: true},
+		{args: arguments{targets: "src", replace: true}, ok: true},
+		{args: arguments{targets: "-,-"}},
+		{args: arguments{targets: "-", replace: true}},
+		{args: arguments{targets: "src,-", replace: true}},
+		{args: arguments{targets: "-", watch: true}},
+		{args: arguments{targets: "-", tui: true}},
+		{args: arguments{targets: "-", diffBase: "main"}},
+		{args: arguments{targets: "-", diffFile: "changes.diff"}},
+		{args: arguments{targets: "src,-", checkpoint: "scan.checkpoint"}},
+		{args: arguments{targets: "src", checkpoint: "scan.checkpoint"}, ok: true},
+	}
+	for _, test := range tests {
+		p := &program{args: test.args}
+		err := p.validateStdinTarget()
+		if test.ok && err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.args, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%+v: expected an error", test.args)
+		}
+	}
+}
+
+func TestStdinTargetReplace(t *testing.T) {
+	p := &program{
+		args: arguments{
+			targets:      "-",
+			pattern:      "f($x)",
+			format:       defaultFormat,
+			replace:      true,
+			workers:      1,
+			sort:         "path",
+			progressMode: "none",
+		},
+	}
+	if err := p.validateFlags(); err == nil {
+		t.Errorf("stdin target is accepted with -i")
+	}
+}
+
+func TestReadStdin(t *testing.T) {
+	stdin, err := ioutil.TempFile("", "phpgrep-stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdin.Name())
+	defer stdin.Close()
+	if _, err := stdin.WriteString("<?php\nf(1);\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = oldStdin }()
+
+	// The display name is not a file name, it's never read from the disk.
+	p := &program{args: arguments{stdinFilename: "src/a.php"}, maxFileSize: 1}
+	f, err := p.readFileContents(stdinTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fileContents{filename: "src/a.php", data: []byte("<?php\nf(1);\n")}
+	if diff := cmp.Diff(want, f, cmp.AllowUnexported(fileContents{})); diff != "" {
+		t.Errorf("stdin contents mismatch (-want +have):\n%s", diff)
+	}
+}
+
+func TestWalkStdinTarget(t *testing.T) {
+	p := &program{
+		args: arguments{
+			targets:        "-",
+			workers:        2,
+			phpFileExtList: []string{".php"},
+		},
+	}
+	// The stdin target is always sent as is, like any other explicitly passed file.
+	have, err := p.collectPHPFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{stdinTarget}, have); diff != "" {
+		t.Errorf("files mismatch (-want +have):\n%s", diff)
+	}
+}
@@ -0,0 +1,610 @@
+package phpgrep
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/VKCOM/noverify/src/quickfix"
+)
+
+const tuiHelp = "j/k: move  n/p: next/prev file  x: false positive  r: select replacement  a: apply replacements  q: quit"
+
+const (
+	tuiCursorStyle  = "\033[7m"
+	tuiCaptureColor = "dark-blue"
+)
+
+type tuiMatchState struct {
+	falsePositive bool
+	selected      bool
+	replaced      bool
+}
+
+type tuiItem struct {
+	// matchIndex is -1 for the file header items.
+	matchIndex int
+	filename   string
+	numMatches int
+}
+
+// tuiBrowser is a full-screen terminal UI for the match results triage.
+//
+// It doesn't use any third-party terminal library: the terminal is put
+// into the raw mode with stty and everything is drawn with ANSI escapes.
+type tuiBrowser struct {
+	p *program
+
+	tty         *os.File
+	sttyState   string
+	rows        int
+	cols        int
+	statusLine  string
+	cursor      int
+	scrollStart int
+
+	matches       []match
+	states        []tuiMatchState
+	items         []tuiItem
+	files         map[string][]byte
+	modifiedFiles map[string]bool
+}
+
+func (p *program) browseMatches() error {
+	if !p.args.tui {
+		return nil
+	}
+
+	var matches []match
+	for _, w := range p.workers {
+		matches = append(matches, w.matches...)
+	}
+	if len(matches) == 0 {
+		log.Printf("found 0 matches")
+		return nil
+	}
+	sortMatches(matches)
+	if uint(len(matches)) > p.args.limit {
+		log.Printf("results limited to %d matches", p.args.limit)
+		matches = matches[:p.args.limit]
+	}
+	p.annotateMatches(matches, "")
+
+	b := newTUIBrowser(p, matches)
+	if err := b.openTerminal(); err != nil {
+		return err
+	}
+	err := b.loop()
+	b.closeTerminal()
+	if err != nil {
+		return err
+	}
+
+	return b.writeFalsePositives()
+}
+
+// newTUIBrowser creates a browser for the sorted non-empty matches list.
+func newTUIBrowser(p *program, matches []match) *tuiBrowser {
+	b := &tuiBrowser{
+		p:             p,
+		rows:          24,
+		cols:          80,
+		matches:       matches,
+		states:        make([]tuiMatchState, len(matches)),
+		files:         make(map[string][]byte),
+		modifiedFiles: make(map[string]bool),
+	}
+	for i, m := range matches {
+		if len(b.items) == 0 || b.items[len(b.items)-1].filename != m.filename {
+			b.items = append(b.items, tuiItem{matchIndex: -1, filename: m.filename})
+		}
+		b.items = append(b.items, tuiItem{matchIndex: i, filename: m.filename})
+	}
+	for i := range b.items {
+		if b.items[i].matchIndex == -1 {
+			for j := i + 1; j < len(b.items) && b.items[j].matchIndex != -1; j++ {
+				b.items[i].numMatches++
+			}
+		}
+	}
+	b.cursor = 1 // The first item is always a file header
+	return b
+}
+
+func (b *tuiBrowser) openTerminal() error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("open terminal: %v", err)
+	}
+	b.tty = tty
+
+	state, err := b.stty("-g")
+	if err != nil {
+		tty.Close()
+		return fmt.Errorf("save terminal state: %v", err)
+	}
+	b.sttyState = strings.TrimSpace(state)
+	if _, err := b.stty("raw", "-echo"); err != nil {
+		tty.Close()
+		return fmt.Errorf("enable terminal raw mode: %v", err)
+	}
+
+	// Switch to the alternate screen and hide the cursor.
+	b.tty.WriteString("\033[?1049h\033[?25l")
+	return nil
+}
+
+func (b *tuiBrowser) closeTerminal() {
+	b.tty.WriteString("\033[?25h\033[?1049l")
+	if _, err := b.stty(b.sttyState); err != nil {
+		log.Printf("error: restore terminal state: %v", err)
+	}
+	b.tty.Close()
+}
+
+func (b *tuiBrowser) stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = b.tty
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+func (b *tuiBrowser) updateSize() {
+	b.rows, b.cols = 24, 80
+	out, err := b.stty("size")
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return
+	}
+	rows, err1 := strconv.Atoi(fields[0])
+	cols, err2 := strconv.Atoi(fields[1])
+	if err1 == nil && err2 == nil && rows > 8 && cols > 20 {
+		b.rows, b.cols = rows, cols
+	}
+}
+
+func (b *tuiBrowser) loop() error {
+	buf := make([]byte, 16)
+	for {
+		b.updateSize()
+		b.draw()
+		b.statusLine = ""
+
+		n, err := b.tty.Read(buf)
+		if err != nil {
+			return err
+		}
+		switch key := string(buf[:n]); key {
+		case "q", "\x03": // q or Ctrl+C
+			return nil
+		case "j", "\033[B":
+			b.moveCursor(+1)
+		case "k", "\033[A":
+			b.moveCursor(-1)
+		case "n":
+			b.moveFile(+1)
+		case "p":
+			b.moveFile(-1)
+		case "x":
+			b.toggleFalsePositive()
+		case "r":
+			b.toggleSelected()
+		case "a":
+			b.applyReplacements()
+		}
+	}
+}
+
+func (b *tuiBrowser) moveCursor(delta int) {
+	for i := b.cursor + delta; i >= 0 && i < len(b.items); i += delta {
+		if b.items[i].matchIndex != -1 {
+			b.cursor = i
+			return
+		}
+	}
+}
+
+func (b *tuiBrowser) moveFile(delta int) {
+	filename := b.items[b.cursor].filename
+	for i := b.cursor + delta; i >= 0 && i < len(b.items); i += delta {
+		if b.items[i].matchIndex != -1 && b.items[i].filename != filename {
+			b.cursor = i
+			if delta < 0 {
+				// Go to the first match of that file.
+				for b.items[b.cursor-1].matchIndex != -1 {
+					b.cursor--
+				}
+			}
+			return
+		}
+	}
+}
+
+func (b *tuiBrowser) currentMatch() (*match, *tuiMatchState) {
+	i := b.items[b.cursor].matchIndex
+	return &b.matches[i], &b.states[i]
+}
+
+func (b *tuiBrowser) toggleFalsePositive() {
+	if b.p.args.excludeResults == "" {
+		b.statusLine = "use --exclude-results to specify the file for false positives"
+		return
+	}
+	_, state := b.currentMatch()
+	state.falsePositive = !state.falsePositive
+	if state.falsePositive {
+		state.selected = false
+	}
+}
+
+func (b *tuiBrowser) toggleSelected() {
+	if !b.p.args.replace {
+		b.statusLine = "use -i flag to enable the replacements"
+		return
+	}
+	m, state := b.currentMatch()
+	switch {
+	case state.replaced:
+		b.statusLine = "this match is already replaced"
+	case b.modifiedFiles[m.filename]:
+		b.statusLine = m.filename + " was modified, re-run phpgrep to replace more matches in it"
+	case state.falsePositive:
+		b.statusLine = "false positive matches can't be replaced"
+	default:
+		state.selected = !state.selected
+	}
+}
+
+func (b *tuiBrowser) applyReplacements() {
+	if !b.p.args.replace {
+		b.statusLine = "use -i flag to enable the replacements"
+		return
+	}
+
+	editsByFilename := make(map[string][]quickfix.TextEdit)
+	replaced := 0
+	for i, m := range b.matches {
+		if !b.states[i].selected {
+			continue
+		}
+		replacement, err := b.renderReplacement(m)
+		if err != nil {
+			b.statusLine = "error: " + err.Error()
+			return
+		}
+		editsByFilename[m.filename] = append(editsByFilename[m.filename], quickfix.TextEdit{
+			StartPos:    m.startPos,
+			EndPos:      m.endPos,
+			Replacement: replacement,
+		})
+	}
+	for filename, fixes := range editsByFilename {
+		contents, err := b.readFile(filename)
+		if err != nil {
+			b.statusLine = "error: " + err.Error()
+			return
+		}
+		if err := quickfix.Apply(filename, contents, fixes); err != nil {
+			b.statusLine = fmt.Sprintf("error: edit %s: %v", filename, err)
+			return
+		}
+		shiftMatches(b.matches, filename, contents, fixes)
+		b.modifiedFiles[filename] = true
+		delete(b.files, filename)
+		replaced += len(fixes)
+	}
+	for i := range b.states {
+		if b.states[i].selected {
+			b.states[i].selected = false
+			b.states[i].replaced = true
+		}
+	}
+	b.statusLine = fmt.Sprintf("replaced %d matches", replaced)
+}
+
+// shiftMatches updates the positions of the filename matches after the edits are applied.
+// The edits are sorted by their positions and don't overlap.
+func shiftMatches(matches []match, filename string, contents []byte, edits []quickfix.TextEdit) {
+	// shiftPos maps the position before the edits to the position after them.
+	// The positions inside the edit are clamped to the replacement.
+	shiftPos := func(pos int) int {
+		shift := 0
+		for _, e := range edits {
+			if e.EndPos <= pos {
+				shift += len(e.Replacement) - (e.EndPos - e.StartPos)
+				continue
+			}
+			if e.StartPos < pos {
+				offset := pos - e.StartPos
+				if offset > len(e.Replacement) {
+					offset = len(e.Replacement)
+				}
+				return e.StartPos + shift + offset
+			}
+			break
+		}
+		return pos + shift
+	}
+	// shiftLine returns the number of the lines added before the pos.
+	shiftLine := func(pos int) int {
+		shift := 0
+		for _, e := range edits {
+			if e.EndPos > pos {
+				break
+			}
+			shift += strings.Count(e.Replacement, "\n") - bytes.Count(contents[e.StartPos:e.EndPos], []byte("\n"))
+		}
+		return shift
+	}
+
+	for i := range matches {
+		m := &matches[i]
+		if m.filename != filename {
+			continue
+		}
+		m.line += shiftLine(m.startPos)
+		m.endLine += shiftLine(m.endPos)
+		for j := range m.captures {
+			c := &m.captures[j]
+			c.startPos, c.endPos = shiftPos(c.startPos), shiftPos(c.endPos)
+		}
+		m.startPos, m.endPos = shiftPos(m.startPos), shiftPos(m.endPos)
+	}
+}
+
+func (b *tuiBrowser) renderReplacement(m match) (string, error) {
+	return renderTemplate(m, renderConfig{
+		tmpl:        b.p.outputTemplate,
+		colors:      false,
+		multiline:   true,
+		absFilename: false,
+		args:        &b.p.args,
+	})
+}
+
+func (b *tuiBrowser) writeFalsePositives() error {
+	var lines []string
+	for i, m := range b.matches {
+		if b.states[i].falsePositive {
+			lines = append(lines, fmt.Sprintf("%s:%d", m.filename, m.line))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(b.p.args.excludeResults, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("open exclude-results file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		return fmt.Errorf("write exclude-results file: %v", err)
+	}
+	log.Printf("added %d false positives to %s", len(lines), b.p.args.excludeResults)
+	return nil
+}
+
+func (b *tuiBrowser) readFile(filename string) ([]byte, error) {
+	if data, ok := b.files[filename]; ok {
+		return data, nil
+	}
+	if archive, _, ok := splitArchiveEntry(filename); ok {
+		// All archive entries are cached, so it's only read once.
+		err := b.p.readArchive(archive, func(f fileContents) {
+			if !f.tooLarge {
+				b.files[f.filename] = f.data
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %v", err)
+		}
+		data, ok := b.files[filename]
+		if !ok {
+			return nil, fmt.Errorf("%s: archive entry not found", filename)
+		}
+		return data, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	b.files[filename] = data
+	return data, nil
+}
+
+func (b *tuiBrowser) draw() {
+	// Don't let the last line feed scroll the screen.
+	b.tty.WriteString(strings.TrimSuffix(b.render(), "\r\n"))
+}
+
+// colorize is like mustColorizeText, but it respects the --no-color.
+func (b *tuiBrowser) colorize(s, color string) string {
+	if b.p.args.noColor {
+		return s
+	}
+	return mustColorizeText(s, color)
+}
+
+// render returns the entire screen contents.
+func (b *tuiBrowser) render() string {
+	var out strings.Builder
+
+	out.WriteString("\033[H\033[2J")
+	listHeight := (b.rows - 3) / 2
+	previewHeight := b.rows - 3 - listHeight
+
+	numMarked := 0
+	numSelected := 0
+	for _, state := range b.states {
+		if state.falsePositive {
+			numMarked++
+		}
+		if state.selected {
+			numSelected++
+		}
+	}
+	b.writeLine(&out, fmt.Sprintf("phpgrep: %d matches, %d false positives, %d selected for replacement",
+		len(b.matches), numMarked, numSelected), "")
+
+	if b.cursor < b.scrollStart+1 {
+		b.scrollStart = b.cursor - 1
+	}
+	if b.cursor >= b.scrollStart+listHeight {
+		b.scrollStart = b.cursor - listHeight + 1
+	}
+	for i := b.scrollStart; i < b.scrollStart+listHeight; i++ {
+		if i >= len(b.items) {
+			out.WriteString("\r\n")
+			continue
+		}
+		item := b.items[i]
+		if item.matchIndex == -1 {
+			header := fmt.Sprintf("%s (%d)", item.filename, item.numMatches)
+			b.writeLine(&out, header, b.p.args.filenameColor)
+			continue
+		}
+		m := b.matches[item.matchIndex]
+		state := b.states[item.matchIndex]
+		mark := "   "
+		switch {
+		case state.replaced:
+			mark = "[+]"
+		case state.falsePositive:
+			mark = "[x]"
+		case state.selected:
+			mark = "[r]"
+		}
+		text := strings.TrimSpace(strings.ReplaceAll(m.text, "\n", `\n`))
+		line := fmt.Sprintf("  %s %5d: %s", mark, m.line, text)
+		if i == b.cursor {
+			b.writeLine(&out, line, "cursor")
+		} else {
+			b.writeLine(&out, line, "")
+		}
+	}
+
+	b.writeLine(&out, strings.Repeat("-", b.cols), "")
+	b.drawPreview(&out, previewHeight)
+
+	status := tuiHelp
+	if b.statusLine != "" {
+		status = b.statusLine
+	}
+	b.writeLine(&out, status, "")
+	return out.String()
+}
+
+func (b *tuiBrowser) drawPreview(out *strings.Builder, height int) {
+	m, state := b.currentMatch()
+	data, err := b.readFile(m.filename)
+	if err != nil {
+		b.writeLine(out, "error: "+err.Error(), "")
+		for i := 1; i < height; i++ {
+			out.WriteString("\r\n")
+		}
+		return
+	}
+
+	// The modified file matches can't be replaced, their captures may be outdated.
+	if b.p.args.replace && !state.replaced && !b.modifiedFiles[m.filename] {
+		replacement, err := b.renderReplacement(*m)
+		if err != nil {
+			replacement = "error: " + err.Error()
+		}
+		b.writeLine(out, "replacement: "+strings.ReplaceAll(replacement, "\n", `\n`), b.p.args.lineColor)
+		height--
+	}
+
+	lineStarts := []int{0}
+	for i, ch := range data {
+		if ch == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+
+	// styles[i] is a color for the byte at data[i].
+	styles := make(map[int]string, m.endPos-m.startPos)
+	for i := m.startPos; i < m.endPos; i++ {
+		styles[i] = b.p.args.matchColor
+	}
+	for _, c := range m.captures {
+		for i := c.startPos; i < c.endPos; i++ {
+			styles[i] = tuiCaptureColor
+		}
+	}
+
+	firstLine := m.line - height/2
+	if firstLine < 1 {
+		firstLine = 1
+	}
+	for line := firstLine; line < firstLine+height; line++ {
+		if line > len(lineStarts) {
+			out.WriteString("\r\n")
+			continue
+		}
+		start := lineStarts[line-1]
+		end := len(data)
+		if line < len(lineStarts) {
+			end = lineStarts[line] - 1
+		}
+		b.writePreviewLine(out, data, line, start, end, styles)
+	}
+}
+
+func (b *tuiBrowser) writePreviewLine(out *strings.Builder, data []byte, line, start, end int, styles map[int]string) {
+	prefix := fmt.Sprintf("%5d  ", line)
+	out.WriteString(b.colorize(prefix, b.p.args.lineColor))
+	width := len(prefix)
+
+	var segment bytes.Buffer
+	segmentStyle := ""
+	flush := func() {
+		if segment.Len() != 0 {
+			out.WriteString(b.colorize(segment.String(), segmentStyle))
+			segment.Reset()
+		}
+	}
+	for i := start; i < end && width < b.cols; i++ {
+		ch := data[i]
+		if ch == '\r' {
+			continue
+		}
+		if styles[i] != segmentStyle {
+			flush()
+			segmentStyle = styles[i]
+		}
+		if ch == '\t' {
+			segment.WriteString("    ")
+			width += 4
+			continue
+		}
+		segment.WriteByte(ch)
+		width++
+	}
+	flush()
+	out.WriteString("\r\n")
+}
+
+func (b *tuiBrowser) writeLine(out *strings.Builder, s, style string) {
+	if len(s) > b.cols {
+		s = s[:b.cols]
+	}
+	switch style {
+	case "":
+		out.WriteString(s)
+	case "cursor":
+		out.WriteString(tuiCursorStyle + s + strings.Repeat(" ", b.cols-len(s)) + "\033[0m")
+	default:
+		out.WriteString(b.colorize(s, style))
+	}
+	out.WriteString("\r\n")
+}
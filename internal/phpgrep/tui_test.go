@@ -0,0 +1,255 @@
+package phpgrep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/VKCOM/noverify/src/quickfix"
+)
+
+func newTUITestMatches(filenames ...string) []match {
+	var matches []match
+	for i, filename := range filenames {
+		matches = append(matches, match{filename: filename, line: i + 1, text: "f()", matchLength: 3})
+	}
+	return matches
+}
+
+func TestTUINavigation(t *testing.T) {
+	// Items: a.php header, 1, 2, b.php header, 4, c.php header, 6, 7.
+	b := newTUIBrowser(&program{}, newTUITestMatches("a.php", "a.php", "b.php", "c.php", "c.php"))
+
+	tests := []struct {
+		key    string
+		cursor int
+	}{
+		{"j", 2},
+		{"j", 4},
+		{"j", 6},
+		{"j", 7},
+		{"j", 7},
+		{"k", 6},
+		{"p", 4},
+		{"p", 1},
+		{"p", 1},
+		{"n", 4},
+		{"n", 6},
+		{"n", 6},
+		{"k", 4},
+		{"k", 2},
+		{"k", 1},
+		{"k", 1},
+	}
+
+	if b.cursor != 1 {
+		t.Fatalf("initial cursor: have %d, want 1", b.cursor)
+	}
+	for i, test := range tests {
+		switch test.key {
+		case "j":
+			b.moveCursor(+1)
+		case "k":
+			b.moveCursor(-1)
+		case "n":
+			b.moveFile(+1)
+		case "p":
+			b.moveFile(-1)
+		}
+		if b.cursor != test.cursor {
+			t.Errorf("step %d (%s): have cursor %d, want %d", i, test.key, b.cursor, test.cursor)
+		}
+	}
+
+	headers := map[int]int{0: 2, 3: 1, 5: 2}
+	for i, numMatches := range headers {
+		if b.items[i].matchIndex != -1 || b.items[i].numMatches != numMatches {
+			t.Errorf("item %d: have %+v, want a header with %d matches", i, b.items[i], numMatches)
+		}
+	}
+}
+
+func TestTUIToggle(t *testing.T) {
+	p := &program{}
+	b := newTUIBrowser(p, newTUITestMatches("a.php", "a.php", "b.php"))
+	_, state := b.currentMatch()
+
+	b.toggleFalsePositive()
+	if state.falsePositive || b.statusLine == "" {
+		t.Errorf("false positive is marked without --exclude-results")
+	}
+	b.toggleSelected()
+	if state.selected || b.statusLine == "" {
+		t.Errorf("replacement is selected without -i")
+	}
+
+	p.args.excludeResults = "baseline.txt"
+	p.args.replace = true
+	b.statusLine = ""
+
+	b.toggleSelected()
+	if !state.selected {
+		t.Errorf("replacement is not selected")
+	}
+	// Marking a false positive drops the selection.
+	b.toggleFalsePositive()
+	if !state.falsePositive || state.selected {
+		t.Errorf("have %+v after marking a false positive", *state)
+	}
+	b.toggleSelected()
+	if state.selected || b.statusLine == "" {
+		t.Errorf("false positive is selected for a replacement")
+	}
+	b.toggleFalsePositive()
+	if state.falsePositive {
+		t.Errorf("false positive mark is not removed")
+	}
+
+	b.statusLine = ""
+	b.modifiedFiles["a.php"] = true
+	b.toggleSelected()
+	if state.selected || b.statusLine == "" {
+		t.Errorf("the modified file match is selected for a replacement")
+	}
+
+	b.statusLine = ""
+	b.moveFile(+1)
+	_, state = b.currentMatch()
+	state.replaced = true
+	b.toggleSelected()
+	if state.selected || b.statusLine == "" {
+		t.Errorf("the replaced match is selected again")
+	}
+}
+
+func TestShiftMatches(t *testing.T) {
+	contents := "<?php\nf(1); f(2);\nf(3); $x = f(4);\n"
+	newMatch := func(filename, text string) match {
+		start := strings.Index(contents, text)
+		m := match{
+			filename: filename,
+			line:     strings.Count(contents[:start], "\n") + 1,
+			startPos: start,
+			endPos:   start + len(text),
+		}
+		m.endLine = m.line + strings.Count(text, "\n")
+		// The captured argument.
+		m.captures = []capture{{name: "x", startPos: start + 2, endPos: start + 3}}
+		return m
+	}
+	matches := []match{
+		newMatch("a.php", "f(1)"),
+		newMatch("a.php", "f(2)"),
+		newMatch("a.php", "f(3)"),
+		newMatch("a.php", "f(4)"),
+		newMatch("b.php", "f(2)"),
+	}
+	orig := make([]match, len(matches))
+	copy(orig, matches)
+	// The captures are shifted in place.
+	for i := range orig {
+		orig[i].captures = append([]capture(nil), matches[i].captures...)
+	}
+
+	edits := []quickfix.TextEdit{
+		{StartPos: matches[0].startPos, EndPos: matches[0].endPos, Replacement: "g(\n1)"},
+		{StartPos: matches[2].startPos, EndPos: matches[2].endPos, Replacement: "3"},
+	}
+	var newContents strings.Builder
+	pos := 0
+	for _, e := range edits {
+		newContents.WriteString(contents[pos:e.StartPos])
+		newContents.WriteString(e.Replacement)
+		pos = e.EndPos
+	}
+	newContents.WriteString(contents[pos:])
+	have := newContents.String()
+
+	shiftMatches(matches, "a.php", []byte(contents), edits)
+
+	wantTexts := []string{"g(\n1)", "f(2)", "3", "f(4)"}
+	for i, want := range wantTexts {
+		m := matches[i]
+		if text := have[m.startPos:m.endPos]; text != want {
+			t.Errorf("match %d: have text %q, want %q", i, text, want)
+		}
+		if line := strings.Count(have[:m.startPos], "\n") + 1; m.line != line {
+			t.Errorf("match %d: have line %d, want %d", i, m.line, line)
+		}
+		if endLine := strings.Count(have[:m.endPos], "\n") + 1; m.endLine != endLine {
+			t.Errorf("match %d: have end line %d, want %d", i, m.endLine, endLine)
+		}
+	}
+	for _, i := range []int{1, 3} {
+		c := matches[i].captures[0]
+		if text := have[c.startPos:c.endPos]; text != contents[orig[i].captures[0].startPos:orig[i].captures[0].endPos] {
+			t.Errorf("match %d: have capture %q", i, text)
+		}
+	}
+	if matches[4].startPos != orig[4].startPos || matches[4].line != orig[4].line {
+		t.Errorf("other file match is shifted: %+v", matches[4])
+	}
+}
+
+func TestTUIArchivePreview(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-tui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "test.zip")
+	if err := ioutil.WriteFile(archive, makeTestZip(t), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &program{
+		args: arguments{phpFileExtList: []string{".php"}},
+	}
+	b := newTUIBrowser(p, newTUITestMatches(archive+"!/src/a.php"))
+	data, err := b.readFile(archive + "!/src/a.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "<?php f();" {
+		t.Errorf("have %q contents", data)
+	}
+	if _, err := b.readFile(archive + "!/src/missing.php"); err == nil {
+		t.Errorf("expected an error for the missing entry")
+	}
+}
+
+func TestTUIRenderNoColor(t *testing.T) {
+	matches := []match{
+		{
+			filename: "a.php",
+			line:     2,
+			startPos: 6,
+			endPos:   10,
+			text:     "f(1);",
+			captures: []capture{{name: "x", startPos: 8, endPos: 9}},
+		},
+	}
+	for _, noColor := range []bool{false, true} {
+		p := &program{
+			args: arguments{
+				noColor:       noColor,
+				filenameColor: "dark-red",
+				lineColor:     "dark-green",
+				matchColor:    "red",
+			},
+		}
+		b := newTUIBrowser(p, matches)
+		b.files["a.php"] = []byte("<?php\nf(1);\n")
+		screen := b.render()
+
+		if !strings.Contains(screen, tuiCursorStyle) {
+			t.Errorf("noColor=%v: the cursor is not highlighted", noColor)
+		}
+		hasColors := strings.Contains(screen, "\033[3")
+		if hasColors == noColor {
+			t.Errorf("noColor=%v: have colors=%v\n%q", noColor, hasColors, screen)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package phpgrep
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errWalkStopped = errors.New("walk stopped")
+
+// dirTask is a directory to be walked.
+type dirTask struct {
+	path string
+	rel  string // See walkedPath
+
+	// ignore is a matcher for the directory entries,
+	// it doesn't include the directory own ignore files yet.
+	ignore *ignoreMatcher
+}
+
+// dirQueue is an unbounded queue of directories to be walked.
+//
+// It's unbounded because the walkers push the subdirectories
+// into the same queue they pop from.
+type dirQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dirs    []dirTask
+	pending int // Queued dirs plus dirs that are being walked right now
+	aborted bool
+}
+
+func newDirQueue() *dirQueue {
+	q := &dirQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *dirQueue) push(dir dirTask) {
+	q.mu.Lock()
+	q.dirs = append(q.dirs, dir)
+	q.pending++
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// pop returns the next directory to walk.
+// It returns false when there is nothing left to walk.
+func (q *dirQueue) pop() (dirTask, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.dirs) == 0 && q.pending != 0 && !q.aborted {
+		q.cond.Wait()
+	}
+	if len(q.dirs) == 0 || q.aborted {
+		return dirTask{}, false
+	}
+	dir := q.dirs[len(q.dirs)-1]
+	q.dirs = q.dirs[:len(q.dirs)-1]
+	return dir, true
+}
+
+// done should be called after every popped directory is walked.
+func (q *dirQueue) done() {
+	q.mu.Lock()
+	q.pending--
+	finished := q.pending == 0
+	q.mu.Unlock()
+	if finished {
+		q.cond.Broadcast()
+	}
+}
+
+func (q *dirQueue) abort() {
+	q.mu.Lock()
+	q.aborted = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// walkTargets sends all PHP files from the comma-separated targets list
+// to the filenames channel. It returns after the entire walk is finished
+// or the stop channel is closed.
+//
+// All targets are walked in parallel by several goroutines.
+// The files order is not deterministic.
+func (p *program) walkTargets(targets string, filenames chan<- string, stop <-chan struct{}) error {
+	var errMu sync.Mutex
+	var walkErr error
+	q := newDirQueue()
+	setError := func(err error) {
+		errMu.Lock()
+		if walkErr == nil {
+			walkErr = err
+		}
+		errMu.Unlock()
+		q.abort()
+	}
+
+	send := func(filename string) error {
+		select {
+		case filenames <- filename:
+			return nil
+		case <-stop:
+			return errWalkStopped
+		}
+	}
+
+	for _, target := range strings.Split(targets, ",") {
+		target = strings.TrimSpace(target)
+		if target == stdinTarget {
+			// It's always searched, like any other explicitly passed file.
+			if err := send(target); err != nil {
+				return nil
+			}
+			continue
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			return err
+		}
+		// The target root itself can only be excluded by the absolute path.
+		targetPath := &walkedPath{path: target, isDir: info.IsDir()}
+		if !info.IsDir() {
+			targetPath.rel = info.Name()
+		}
+		if p.isExcluded(targetPath) {
+			p.stats.countSkippedExclude()
+			continue
+		}
+		if info.IsDir() {
+			task := dirTask{path: target}
+			if !p.args.noIgnore {
+				task.ignore, err = targetIgnoreMatcher(target)
+				if err != nil {
+					return err
+				}
+			}
+			q.push(task)
+			continue
+		}
+		if isArchiveFile(info.Name()) {
+			// Its entries are filtered while the archive is read.
+			if err := send(target); err != nil {
+				return nil
+			}
+			continue
+		}
+		p.stats.countWalked()
+		if !p.isSearchedFile(target, info.Name()) {
+			p.stats.countSkippedExtension()
+			continue
+		}
+		if !p.isIncluded(targetPath) {
+			p.stats.countSkippedExclude()
+			continue
+		}
+		if !p.inShard(targetPath.rel) {
+			p.stats.countSkippedShard()
+			continue
+		}
+		if err := send(target); err != nil {
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(p.args.workers)
+	for i := 0; i < p.args.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := q.pop()
+				if !ok {
+					return
+				}
+				if err := p.walkDir(dir, q, send); err != nil {
+					setError(err)
+				}
+				q.done()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if walkErr == errWalkStopped {
+		return nil
+	}
+	return walkErr
+}
+
+func (p *program) walkDir(task dirTask, q *dirQueue, send func(filename string) error) error {
+	dir := task.path
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	// Unlike os.ReadDir, it doesn't sort the entries.
+	// Also, unlike filepath.Walk, we don't need to lstat every file.
+	entries, err := f.ReadDir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	ignore := task.ignore
+	if !p.args.noIgnore {
+		names := make(map[string]bool)
+		for _, e := range entries {
+			if e.Name() == ".git" || isIgnoreFile(e.Name()) {
+				names[e.Name()] = true
+			}
+		}
+		if len(names) != 0 {
+			ignore = loadIgnoreRules(ignore, dir, func(name string) bool {
+				return names[name]
+			})
+		}
+	}
+
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if !p.args.noIgnore {
+			if e.IsDir() && e.Name() == ".git" {
+				continue
+			}
+			if ignore.isIgnored(e.Name(), e.IsDir()) {
+				p.stats.countSkippedIgnore()
+				continue
+			}
+		}
+		rel := e.Name()
+		if task.rel != "" {
+			rel = task.rel + "/" + e.Name()
+		}
+		entryPath := &walkedPath{path: path, rel: rel, isDir: e.IsDir()}
+		if p.isExcluded(entryPath) {
+			p.stats.countSkippedExclude()
+			continue
+		}
+		if e.IsDir() {
+			q.push(dirTask{path: path, rel: rel, ignore: ignore.child(e.Name())})
+			continue
+		}
+		p.stats.countWalked()
+		if !p.isSearchedFile(path, e.Name()) {
+			p.stats.countSkippedExtension()
+			continue
+		}
+		if !p.isIncluded(entryPath) {
+			p.stats.countSkippedExclude()
+			continue
+		}
+		if !p.inShard(rel) {
+			p.stats.countSkippedShard()
+			continue
+		}
+		if err := send(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectPHPFiles returns the sorted list of all PHP files to be searched.
+func (p *program) collectPHPFiles() ([]string, error) {
+	var result []string
+	filenames := make(chan string, p.args.workers)
+	done := make(chan struct{})
+	go func() {
+		for filename := range filenames {
+			result = append(result, filename)
+		}
+		close(done)
+	}()
+	err := p.walkFiles(filenames, nil)
+	close(filenames)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (p *program) isPHPFile(name string) bool {
+	for _, ext := range p.args.phpFileExtList {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
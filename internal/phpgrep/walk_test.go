@@ -0,0 +1,217 @@
+package phpgrep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWalkTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phpgrep-walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".git/HEAD":             "ref: refs/heads/main\n",
+		".gitignore":            "ignored/\n*.gen.php\n",
+		"src/.gitignore":        "local.php\n!keep.gen.php\n",
+		"src/b.php":             "<?php\n",
+		"src/a.php":             "<?php\n",
+		"src/README.md":         "# readme\n",
+		"src/x.inc":             "<?php\n",
+		"src/f.gen.php":         "<?php\n",
+		"src/keep.gen.php":      "<?php\n",
+		"src/ignored/e.php":     "<?php\n",
+		"src/sub/c.php":         "<?php\n",
+		"src/sub/local.php":     "<?php\n",
+		"src/sub/deep/d.php":    "<?php\n",
+		"lib/local.php":         "<?php\n",
+		"lib/Tests/FooTest.php": "<?php\n",
+		"vendor/v.php":          "<?php\n",
+	}
+	for filename, contents := range files {
+		filename = filepath.Join(dir, filepath.FromSlash(filename))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	tests := []struct {
+		name     string
+		targets  string
+		excludes []string
+		includes []string
+		phpExt   []string
+		noIgnore bool
+		want     []string
+	}{
+		{
+			name:    "all",
+			targets: ".",
+			want: []string{
+				"lib/Tests/FooTest.php",
+				"lib/local.php",
+				"src/a.php",
+				"src/b.php",
+				"src/keep.gen.php",
+				"src/sub/c.php",
+				"src/sub/deep/d.php",
+				"vendor/v.php",
+			},
+		},
+		{
+			name:     "excludes",
+			targets:  ".",
+			excludes: []string{"glob:vendor/", "glob:**/Tests/**", "re:^src/sub/deep"},
+			want: []string{
+				"lib/local.php",
+				"src/a.php",
+				"src/b.php",
+				"src/keep.gen.php",
+				"src/sub/c.php",
+			},
+		},
+		{
+			name:     "includes",
+			targets:  "src",
+			includes: []string{"glob:*.inc", "glob:sub/**"},
+			phpExt:   []string{".php", ".inc"},
+			want: []string{
+				"src/sub/c.php",
+				"src/sub/deep/d.php",
+				"src/x.inc",
+			},
+		},
+		{
+			name:     "unprefixed globs",
+			targets:  ".",
+			includes: []string{"src/**"},
+			excludes: []string{"**/Tests/**"},
+			want: []string{
+				"src/a.php",
+				"src/b.php",
+				"src/keep.gen.php",
+				"src/sub/c.php",
+				"src/sub/deep/d.php",
+			},
+		},
+		{
+			// The parent directories ignore files are applied to the nested targets.
+			name:    "nested targets",
+			targets: "src/sub,lib",
+			want: []string{
+				"lib/Tests/FooTest.php",
+				"lib/local.php",
+				"src/sub/c.php",
+				"src/sub/deep/d.php",
+			},
+		},
+		{
+			// Explicitly passed files are never ignored.
+			name:    "file targets",
+			targets: "src/f.gen.php,src/sub/local.php,src/a.php",
+			want: []string{
+				"src/a.php",
+				"src/f.gen.php",
+				"src/sub/local.php",
+			},
+		},
+		{
+			name:     "no ignore",
+			targets:  "src",
+			noIgnore: true,
+			want: []string{
+				"src/a.php",
+				"src/b.php",
+				"src/f.gen.php",
+				"src/ignored/e.php",
+				"src/keep.gen.php",
+				"src/sub/c.php",
+				"src/sub/deep/d.php",
+				"src/sub/local.php",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		phpExt := test.phpExt
+		if phpExt == nil {
+			phpExt = []string{".php"}
+		}
+		p := &program{
+			args: arguments{
+				targets:        test.targets,
+				workers:        4,
+				excludes:       test.excludes,
+				includes:       test.includes,
+				phpFileExtList: phpExt,
+				noIgnore:       test.noIgnore,
+			},
+		}
+		if err := p.compilePathFilters(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		// Run it several times, since the walk order is not deterministic.
+		for i := 0; i < 3; i++ {
+			have, err := p.collectPHPFiles()
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			for j := range have {
+				have[j] = filepath.ToSlash(have[j])
+			}
+			if diff := cmp.Diff(test.want, have); diff != "" {
+				t.Errorf("%s: files mismatch (-want +have):\n%s", test.name, diff)
+				break
+			}
+		}
+	}
+}
+
+func TestDirQueue(t *testing.T) {
+	q := newDirQueue()
+	q.push(dirTask{path: "a"})
+	q.push(dirTask{path: "b"})
+
+	dir, ok := q.pop()
+	if !ok || dir.path != "b" {
+		t.Fatalf("have %q (ok=%v), want b", dir.path, ok)
+	}
+	// The subdirectories are pushed while the parent is still pending.
+	q.push(dirTask{path: "b/c"})
+	q.done()
+	for _, want := range []string{"b/c", "a"} {
+		dir, ok := q.pop()
+		if !ok || dir.path != want {
+			t.Fatalf("have %q (ok=%v), want %s", dir.path, ok, want)
+		}
+		q.done()
+	}
+	if _, ok := q.pop(); ok {
+		t.Errorf("pop from the finished queue succeeded")
+	}
+
+	q = newDirQueue()
+	q.push(dirTask{path: "a"})
+	q.abort()
+	if _, ok := q.pop(); ok {
+		t.Errorf("pop from the aborted queue succeeded")
+	}
+}
@@ -0,0 +1,185 @@
+package phpgrep
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchTargets keeps the targets under observation after the initial search.
+//
+// There is no portable file notification API in the standard library,
+// so we poll the file stamps instead. Only modified files are re-grepped.
+func (p *program) watchTargets() error {
+	if !p.args.watch {
+		return nil
+	}
+
+	results := make(map[string][]string)
+	for _, w := range p.workers {
+		p.annotateMatches(w.matches, "")
+		for _, m := range w.matches {
+			s, err := formatMatch(p.outputTemplate, &p.args, m)
+			if err != nil {
+				return err
+			}
+			results[m.filename] = append(results[m.filename], s)
+		}
+	}
+
+	stamps, err := p.collectFileStamps()
+	if err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(p.args.watchInterval)
+	defer ticker.Stop()
+
+	log.Printf("watching for changes, press Ctrl+C to stop")
+
+	w := p.workers[0]
+	for {
+		select {
+		case <-interrupt:
+			p.matches = int64(countWatchResults(results))
+			return nil
+		case <-ticker.C:
+		}
+
+		newStamps, err := p.collectFileStamps()
+		if err != nil {
+			log.Printf("error: watch: %v", err)
+			continue
+		}
+
+		var changed []string
+		for filename, stamp := range newStamps {
+			if oldStamp, ok := stamps[filename]; !ok || oldStamp != stamp {
+				changed = append(changed, filename)
+			}
+		}
+		for filename := range stamps {
+			if _, ok := newStamps[filename]; !ok {
+				changed = append(changed, filename)
+			}
+		}
+		stamps = newStamps
+		if len(changed) == 0 {
+			continue
+		}
+		sort.Strings(changed)
+
+		var delta []string
+		for _, filename := range changed {
+			var fileResults []string
+			if _, ok := newStamps[filename]; ok {
+				matches, err := w.grepFileMatches(filename)
+				if err != nil {
+					log.Printf("error: execute pattern: %s: %v", filename, err)
+				}
+				if p.blame != nil {
+					p.blame.forget(filename)
+					p.annotateMatches(matches, "")
+				}
+				for _, m := range matches {
+					s, err := formatMatch(p.outputTemplate, &p.args, m)
+					if err != nil {
+						return err
+					}
+					fileResults = append(fileResults, s)
+				}
+			}
+			removed, added := diffWatchResults(results[filename], fileResults)
+			for _, s := range removed {
+				delta = append(delta, "- "+s)
+			}
+			for _, s := range added {
+				delta = append(delta, "+ "+s)
+			}
+			if len(fileResults) == 0 {
+				delete(results, filename)
+			} else {
+				results[filename] = fileResults
+			}
+		}
+
+		switch p.args.watchPrint {
+		case "delta":
+			if len(delta) == 0 {
+				continue
+			}
+			fmt.Println(strings.Join(delta, "\n"))
+		case "all":
+			filenames := make([]string, 0, len(results))
+			for filename := range results {
+				filenames = append(filenames, filename)
+			}
+			sort.Strings(filenames)
+			for _, filename := range filenames {
+				fmt.Println(strings.Join(results[filename], "\n"))
+			}
+		}
+		log.Printf("%d matches after %d file changes", countWatchResults(results), len(changed))
+	}
+}
+
+func (p *program) collectFileStamps() (map[string]fileStamp, error) {
+	filenames, err := p.collectPHPFiles()
+	if err != nil {
+		return nil, err
+	}
+	stamps := make(map[string]fileStamp, len(filenames))
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			// Removed after it was walked.
+			continue
+		}
+		stamps[filename] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
+
+func countWatchResults(results map[string][]string) int {
+	n := 0
+	for _, list := range results {
+		n += len(list)
+	}
+	return n
+}
+
+// diffWatchResults reports the old results that are missing in the new results
+// and vice versa. The results are compared as multisets.
+func diffWatchResults(oldResults, newResults []string) (removed, added []string) {
+	counts := make(map[string]int, len(oldResults))
+	for _, s := range oldResults {
+		counts[s]++
+	}
+	for _, s := range newResults {
+		if counts[s] > 0 {
+			counts[s]--
+			continue
+		}
+		added = append(added, s)
+	}
+	for _, s := range oldResults {
+		if counts[s] > 0 {
+			counts[s]--
+			removed = append(removed, s)
+		}
+	}
+	return removed, added
+}
@@ -0,0 +1,73 @@
+package phpgrep
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffWatchResults(t *testing.T) {
+	tests := []struct {
+		oldResults []string
+		newResults []string
+		removed    []string
+		added      []string
+	}{
+		{
+			oldResults: nil,
+			newResults: nil,
+		},
+		{
+			oldResults: []string{"a.php:1: f()"},
+			newResults: []string{"a.php:1: f()"},
+		},
+		{
+			oldResults: nil,
+			newResults: []string{"a.php:1: f()", "a.php:2: g()"},
+			added:      []string{"a.php:1: f()", "a.php:2: g()"},
+		},
+		{
+			oldResults: []string{"a.php:1: f()", "a.php:2: g()"},
+			newResults: nil,
+			removed:    []string{"a.php:1: f()", "a.php:2: g()"},
+		},
+		{
+			// A line was inserted above the match.
+			oldResults: []string{"a.php:1: f()"},
+			newResults: []string{"a.php:2: f()"},
+			removed:    []string{"a.php:1: f()"},
+			added:      []string{"a.php:2: f()"},
+		},
+		{
+			// Results are compared as multisets.
+			oldResults: []string{"a.php:1: f() + f()", "a.php:1: f() + f()"},
+			newResults: []string{"a.php:1: f() + f()"},
+			removed:    []string{"a.php:1: f() + f()"},
+		},
+		{
+			oldResults: []string{"a.php:1: f()"},
+			newResults: []string{"a.php:1: f()", "a.php:1: f()", "a.php:3: g()"},
+			added:      []string{"a.php:1: f()", "a.php:3: g()"},
+		},
+	}
+
+	for _, test := range tests {
+		removed, added := diffWatchResults(test.oldResults, test.newResults)
+		if diff := cmp.Diff(test.removed, removed); diff != "" {
+			t.Errorf("diff(%q, %q): removed mismatch (-want +have):\n%s", test.oldResults, test.newResults, diff)
+		}
+		if diff := cmp.Diff(test.added, added); diff != "" {
+			t.Errorf("diff(%q, %q): added mismatch (-want +have):\n%s", test.oldResults, test.newResults, diff)
+		}
+	}
+}
+
+func TestCountWatchResults(t *testing.T) {
+	results := map[string][]string{
+		"a.php": {"a.php:1: f()", "a.php:2: f()"},
+		"b.php": {"b.php:1: f()"},
+	}
+	if n := countWatchResults(results); n != 3 {
+		t.Errorf("have %d results, want 3", n)
+	}
+}
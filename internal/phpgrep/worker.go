@@ -3,6 +3,9 @@ package phpgrep
 import (
 	"fmt"
 	"io/ioutil"
+	"log"
+	"path/filepath"
+	"time"
 
 	"github.com/VKCOM/noverify/src/ir"
 	"github.com/VKCOM/noverify/src/ir/irconv"
@@ -20,14 +23,48 @@ type worker struct {
 	needMatchData bool
 	needMatchLine bool
 
-	irconv  *irconv.Converter
-	matches []match
+	irconv   *irconv.Converter
+	literals *literalFilter
+	cache    *resultsCache
+	limit    *matchLimit
+	matches  []match
+	stats    workerStats
+	skipped  *skippedFiles
 
+	// fileSkips are the skipped files report entries of the last grepped file.
+	fileSkips []skippedFile
+
+	// diff is nil unless the search is restricted to the changed lines.
+	diff *diffFilter
+
+	// generated is nil unless --skip-generated is set.
+	generated *generatedDetector
+
+	// sections maps the file extensions to their code section extractors.
+	sections map[string]sectionExtractor
+
+	// Zero values mean that there are no limits.
+	maxFileSize int64
+	fileTimeout time.Duration
+
+	// parseSlots is shared between the workers, see newParseSlots.
+	parseSlots chan struct{}
+
+	// stopped is set when the shared match limit is reached.
+	stopped bool
+
+	// deadline is set for the current file if there is a file timeout.
+	deadline     time.Time
+	nodesVisited int
+	timedOut     bool
+
+	// data is the currently walked code. It's the entire fileData,
+	// unless a code section of a non-PHP file is walked.
 	data     []byte
+	fileData []byte
+	section  *codeSection
 	filename string
 	n        int
-
-	errors []string
 }
 
 func (w *worker) grepFile(filename string) (int, error) {
@@ -35,17 +72,139 @@ func (w *worker) grepFile(filename string) (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("read file: %v", err)
 	}
+	return w.grepData(filename, data)
+}
 
-	root, err := w.parseFile(data)
-	if err != nil {
-		return 0, err
+func (w *worker) grepData(filename string, data []byte) (int, error) {
+	w.fileSkips = w.fileSkips[:0]
+	if w.stopped {
+		if w.limit.reached() {
+			return 0, nil
+		}
+		// Some matches were released after a timeout, there is room for more.
+		w.stopped = false
+	}
+	if !w.checkFileSize(filename, int64(len(data))) {
+		return 0, nil
+	}
+	if w.generated != nil && w.generated.isGenerated(data) {
+		w.stats.skippedGenerated++
+		return 0, nil
+	}
+	w.stats.filesGrepped++
+	if w.literals != nil && !w.literals.mayMatch(data) {
+		w.stats.skippedPrefilter++
+		return 0, nil
+	}
+
+	var cacheKey string
+	if w.cache != nil {
+		cacheKey = w.cache.key(filename, data, w.excludeResults[filename], w.changedLines(filename))
+		if matches, ok := w.cache.load(cacheKey, filename); ok {
+			w.stats.cacheHits++
+			n := 0
+			for _, m := range matches {
+				if !w.onChangedLines(filename, m.line, m.endLine) {
+					continue
+				}
+				if !w.reserveMatch() {
+					break
+				}
+				w.matches = append(w.matches, m)
+				n++
+			}
+			return n, nil
+		}
+	}
+
+	w.deadline = time.Time{}
+	if w.fileTimeout != 0 {
+		w.deadline = time.Now().Add(w.fileTimeout)
+	}
+	var n int
+	complete := true
+	if extract := w.sections[filepath.Ext(filename)]; extract != nil {
+		start := time.Now()
+		var err error
+		n, complete, err = w.grepSections(filename, data, extract(data))
+		w.stats.addTiming(filename, time.Since(start))
+		if err == errFileTimeout {
+			w.matches = w.matches[:len(w.matches)-n]
+			if w.limit != nil {
+				w.limit.release(n)
+			}
+			w.skipTimedOutFile(filename)
+			return 0, nil
+		}
+	} else {
+		parseStart := time.Now()
+		root, err := w.parseFileWithTimeout(data)
+		parseTime := time.Since(parseStart)
+		w.stats.parseTime += parseTime
+		if err == errFileTimeout {
+			w.skipTimedOutFile(filename)
+			return 0, nil
+		}
+		if err != nil {
+			w.stats.parseFailures++
+			return 0, err
+		}
+
+		matchStart := time.Now()
+		n = w.grepRoot(filename, data, root)
+		matchTime := time.Since(matchStart)
+		w.stats.matchTime += matchTime
+		w.stats.addTiming(filename, parseTime+matchTime)
+	}
+	if w.timedOut {
+		// Partial results would be misleading.
+		w.matches = w.matches[:len(w.matches)-n]
+		if w.limit != nil {
+			w.limit.release(n)
+		}
+		w.skipTimedOutFile(filename)
+		return 0, nil
+	}
+
+	// Don't cache the partial results.
+	if w.cache != nil && !w.stopped && complete {
+		if err := w.cache.store(cacheKey, w.matches[len(w.matches)-n:]); err != nil {
+			log.Printf("error: cache %s results: %v", filename, err)
+		}
 	}
+	return n, nil
+}
+
+func (w *worker) grepRoot(filename string, data []byte, root *ir.Root) int {
+	return w.walkRoot(filename, data, nil, root)
+}
 
-	w.data = data
+// walkRoot collects the root matches. If the section is not nil,
+// the root is parsed from the section code and the positions are mapped to the fileData.
+func (w *worker) walkRoot(filename string, fileData []byte, section *codeSection, root *ir.Root) int {
+	w.data = fileData
+	if section != nil {
+		w.data = section.code
+	}
+	w.fileData = fileData
+	w.section = section
 	w.filename = filename
 	w.n = 0
+	w.nodesVisited = 0
+	w.timedOut = false
 	root.Walk(w)
-	return w.n, nil
+	return w.n
+}
+
+// grepFileMatches is like grepFile, but it returns the file matches
+// instead of appending them to the w.matches slice.
+func (w *worker) grepFileMatches(filename string) ([]match, error) {
+	offset := len(w.matches)
+	_, err := w.grepFile(filename)
+	matches := make([]match, len(w.matches)-offset)
+	copy(matches, w.matches[offset:])
+	w.matches = w.matches[:offset]
+	return matches, err
 }
 
 func (w *worker) parseFile(data []byte) (*ir.Root, error) {
@@ -59,16 +218,29 @@ func (w *worker) parseFile(data []byte) (*ir.Root, error) {
 func (w *worker) LeaveNode(ir.Node) {}
 
 func (w *worker) EnterNode(n ir.Node) bool {
+	if w.stopped || w.checkDeadline() {
+		return false
+	}
+
 	data, ok := w.m.Match(n)
 	if ok && w.acceptMatch(data) {
+		// The changed lines are checked before the reservation,
+		// so the discarded matches don't count towards the limit.
+		pos := w.filePosition(ir.GetPosition(data.Node))
+		if !w.onChangedLines(w.filename, pos.StartLine, pos.EndLine) {
+			return true
+		}
+		if !w.reserveMatch() {
+			return false
+		}
 		w.n++
-		pos := ir.GetPosition(data.Node)
 		m := match{
 			filename: w.filename,
 			line:     pos.StartLine,
+			endLine:  pos.EndLine,
 			startPos: pos.StartPos,
 			endPos:   pos.EndPos,
-			data:     w.maybeCloneData(data),
+			captures: w.maybeCollectCaptures(data),
 		}
 		w.initMatchText(&m, pos)
 		w.matches = append(w.matches, m)
@@ -77,9 +249,34 @@ func (w *worker) EnterNode(n ir.Node) bool {
 	return true
 }
 
+// reserveMatch reports whether one more match can be collected.
+// After the shared limit is reached, the worker stops.
+func (w *worker) reserveMatch() bool {
+	if w.limit == nil {
+		return true
+	}
+	if !w.limit.reserve() {
+		w.stopped = true
+		return false
+	}
+	return true
+}
+
+// truncateMatches keeps only the first max matches in the path order.
+// To amortize the sorting costs, it does nothing until
+// there are at least twice as many matches.
+func (w *worker) truncateMatches(max int) {
+	if len(w.matches) < 2*max {
+		return
+	}
+	sortMatches(w.matches)
+	w.matches = w.matches[:max]
+}
+
 func (w *worker) initMatchText(m *match, pos *position.Position) {
+	data := w.fileData
 	if !w.needMatchLine {
-		m.text = string(w.data[pos.StartPos:pos.EndPos])
+		m.text = string(data[pos.StartPos:pos.EndPos])
 		m.matchStartOffset = 0
 		m.matchLength = len(m.text)
 		return
@@ -91,7 +288,7 @@ func (w *worker) initMatchText(m *match, pos *position.Position) {
 
 	start := pos.StartPos
 	for start > 0 {
-		if isNewline(w.data[start]) {
+		if isNewline(data[start]) {
 			if start != pos.StartPos {
 				start++
 			}
@@ -100,13 +297,13 @@ func (w *worker) initMatchText(m *match, pos *position.Position) {
 		start--
 	}
 	end := pos.EndPos
-	for end < len(w.data) {
-		if isNewline(w.data[end]) {
+	for end < len(data) {
+		if isNewline(data[end]) {
 			break
 		}
 		end++
 	}
-	m.text = string(w.data[start:end])
+	m.text = string(data[start:end])
 	m.matchStartOffset = pos.StartPos - start
 	m.matchLength = pos.EndPos - pos.StartPos
 }
@@ -115,7 +312,7 @@ func (w *worker) acceptMatch(m phpgrep.MatchData) bool {
 	if w.excludeResults != nil {
 		fileExclusionList := w.excludeResults[w.filename]
 		if len(fileExclusionList) != 0 {
-			pos := ir.GetPosition(m.Node)
+			pos := w.filePosition(ir.GetPosition(m.Node))
 			for _, line := range fileExclusionList {
 				if line == pos.StartLine {
 					return false
@@ -145,15 +342,15 @@ func (w *worker) acceptMatch(m phpgrep.MatchData) bool {
 	return true
 }
 
-func (w *worker) maybeCloneData(data phpgrep.MatchData) phpgrep.MatchData {
-	if !w.needMatchData {
-		return phpgrep.MatchData{}
+func (w *worker) maybeCollectCaptures(data phpgrep.MatchData) []capture {
+	if !w.needMatchData || len(data.Capture) == 0 {
+		return nil
 	}
 
-	capture := make([]phpgrep.CapturedNode, len(data.Capture))
-	copy(capture, data.Capture)
-	return phpgrep.MatchData{
-		Node:    data.Node,
-		Capture: capture,
+	captures := make([]capture, len(data.Capture))
+	for i, c := range data.Capture {
+		pos := w.filePosition(ir.GetPosition(c.Node))
+		captures[i] = capture{name: c.Name, startPos: pos.StartPos, endPos: pos.EndPos}
 	}
+	return captures
 }
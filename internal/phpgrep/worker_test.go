@@ -0,0 +1,59 @@
+package phpgrep
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTruncateMatches(t *testing.T) {
+	newMatches := func(filenames ...string) []match {
+		var matches []match
+		for i, filename := range filenames {
+			matches = append(matches, match{filename: filename, line: i + 1, startPos: i * 10})
+		}
+		return matches
+	}
+
+	tests := []struct {
+		matches []match
+		max     int
+		want    []string
+	}{
+		{
+			matches: nil,
+			max:     2,
+			want:    nil,
+		},
+		{
+			// Less than 2*max matches are not sorted and truncated yet.
+			matches: newMatches("c.php", "b.php", "a.php"),
+			max:     2,
+			want:    []string{"c.php:1:0", "b.php:2:10", "a.php:3:20"},
+		},
+		{
+			matches: newMatches("c.php", "b.php", "a.php", "a.php"),
+			max:     2,
+			want:    []string{"a.php:3:20", "a.php:4:30"},
+		},
+		{
+			matches: newMatches("d.php", "c.php", "b.php", "a.php", "b.php"),
+			max:     2,
+			want:    []string{"a.php:4:30", "b.php:3:20"},
+		},
+		{
+			matches: newMatches("b.php", "a.php"),
+			max:     1,
+			want:    []string{"a.php:2:10"},
+		},
+	}
+
+	for _, test := range tests {
+		w := &worker{matches: test.matches}
+		before := matchPositions(test.matches)
+		w.truncateMatches(test.max)
+		if diff := cmp.Diff(test.want, matchPositions(w.matches)); diff != "" {
+			t.Errorf("truncate(%q, %d) mismatch (-want +have):\n%s", before, test.max, diff)
+		}
+	}
+}